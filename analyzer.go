@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Bus samples kept by the analyzer before the oldest are discarded
+const ANALYZER_SAMPLES = 1 << 20
+
+// Sample is the state of the bus lines from a cycle onwards
+type Sample struct {
+	Cycle uint64
+	Lines IEEE488
+}
+
+/*
+Analyzer is a logic analyzer for the IEEE488 bus. Once tapped onto a bus it
+records the lines every time any of them change, timestamped with the cycle
+count of the drive whose sync caused the change.
+
+Each drive has its own cycle counter, so when several drives share a bus
+their timestamps are only as close as the drives are in step. Samples are
+kept in order, so a timestamp is never earlier than the one before it.
+*/
+type Analyzer struct {
+	mutex   sync.Mutex
+	samples []Sample
+	dropped uint64 // Samples discarded to stay within ANALYZER_SAMPLES
+}
+
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{}
+}
+
+// Record the lines if they have changed since the last sample
+func (a *Analyzer) sample(cycle uint64, lines IEEE488) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if n := len(a.samples); n > 0 {
+		last := a.samples[n-1]
+		if lines == last.Lines {
+			return
+		}
+		if cycle < last.Cycle {
+			cycle = last.Cycle
+		}
+	}
+
+	if len(a.samples) == ANALYZER_SAMPLES {
+		a.samples = append(a.samples[:0], a.samples[ANALYZER_SAMPLES/2:]...)
+		a.dropped += ANALYZER_SAMPLES / 2
+	}
+	a.samples = append(a.samples, Sample{cycle, lines})
+}
+
+// Samples returns the recorded samples, oldest first
+func (a *Analyzer) Samples() []Sample {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return append([]Sample(nil), a.samples...)
+}
+
+// Len returns the number of samples recorded
+func (a *Analyzer) Len() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return len(a.samples)
+}
+
+// Dropped returns the number of samples discarded because the analyzer was full
+func (a *Analyzer) Dropped() uint64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.dropped
+}
+
+// Clear discards the recorded samples
+func (a *Analyzer) Clear() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.samples = nil
+	a.dropped = 0
+}
+
+// The single bit lines in a VCD file, with their identifiers
+var vcdLines = []struct {
+	name string
+	id   string
+	line func(IEEE488) IEEEBool
+}{
+	{"DAV", "!", func(i IEEE488) IEEEBool { return i.DAV }},
+	{"EOI", "\"", func(i IEEE488) IEEEBool { return i.EOI }},
+	{"NDAC", "#", func(i IEEE488) IEEEBool { return i.NDAC }},
+	{"NRFD", "$", func(i IEEE488) IEEEBool { return i.NRFD }},
+	{"ATN", "%", func(i IEEE488) IEEEBool { return i.ATN }},
+	{"SRQ", "&", func(i IEEE488) IEEEBool { return i.SRQ }},
+	{"REN", "'", func(i IEEE488) IEEEBool { return i.REN }},
+	{"IFC", "(", func(i IEEE488) IEEEBool { return i.IFC }},
+}
+
+const VCD_DIO = ")"
+
+/*
+WriteVCD writes the samples as a Value Change Dump, e.g. for GTKWave. The
+control lines are shown at their electrical levels, so they are 0 while they
+are asserted. DIO is shown as the data byte on the bus.
+*/
+func (a *Analyzer) WriteVCD(out io.Writer) error {
+	samples := a.Samples()
+	w := bufio.NewWriter(out)
+
+	fmt.Fprintf(w, "$date %s $end\n", time.Now().Format(time.RFC1123))
+	fmt.Fprintln(w, "$version cbm2031 IEEE488 analyzer $end")
+	fmt.Fprintln(w, "$timescale 1us $end")
+	fmt.Fprintln(w, "$scope module ieee488 $end")
+	for _, l := range vcdLines {
+		fmt.Fprintf(w, "$var wire 1 %s %s $end\n", l.id, l.name)
+	}
+	fmt.Fprintf(w, "$var wire 8 %s DIO $end\n", VCD_DIO)
+	fmt.Fprintln(w, "$upscope $end")
+	fmt.Fprintln(w, "$enddefinitions $end")
+
+	/*
+		Samples with the same timestamp go in one block, with the lines as they
+		were after the last of them
+	*/
+	var last *Sample
+	for n, s := range samples {
+		t := s.Cycle * 1000000 / CLOCK_HZ
+		if n+1 < len(samples) && samples[n+1].Cycle*1000000/CLOCK_HZ == t {
+			continue
+		}
+
+		fmt.Fprintf(w, "#%d\n", t)
+		if last == nil {
+			fmt.Fprintln(w, "$dumpvars")
+		}
+		for _, l := range vcdLines {
+			if last == nil || l.line(s.Lines) != l.line(last.Lines) {
+				fmt.Fprintf(w, "%s%s\n", vcdLevel(l.line(s.Lines)), l.id)
+			}
+		}
+		if last == nil || s.Lines.DIO != last.Lines.DIO {
+			fmt.Fprintf(w, "b%08b %s\n", s.Lines.DIO, VCD_DIO)
+		}
+		if last == nil {
+			fmt.Fprintln(w, "$end")
+		}
+		last = &samples[n]
+	}
+
+	return w.Flush()
+}
+
+func vcdLevel(b IEEEBool) string {
+	switch b {
+	case TRUE:
+		return "0"
+	case FALSE:
+		return "1"
+	}
+	return "z"
+}
+
+func (a *Analyzer) WriteVCDFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	err = a.WriteVCD(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzer(t *testing.T) {
+	bus := &IEEEBus{}
+	a := NewAnalyzer()
+	bus.Tap(a)
+
+	var cycle uint64
+	host := &DummyConnector{}
+	host.Reset()
+	port := bus.Connect(host)
+	port.Clock = func() uint64 {
+		return cycle
+	}
+
+	// Only changes are recorded
+	for _, step := range []struct {
+		cycle uint64
+		atn   IEEEBool
+		dio   Byte
+	}{
+		{10, FALSE, 0},
+		{20, FALSE, 0},
+		{30, TRUE, 0},
+		{40, TRUE, 0x28},
+	} {
+		cycle = step.cycle
+		host.Update(func(out *IEEE488) {
+			out.ATN = step.atn
+			out.DIO = step.dio
+		})
+		port.Sync()
+	}
+
+	samples := a.Samples()
+	if len(samples) != 3 {
+		t.Fatalf("%d samples, want 3", len(samples))
+	}
+	for n, want := range []uint64{10, 30, 40} {
+		if samples[n].Cycle != want {
+			t.Errorf("sample %d at cycle %d, want %d", n, samples[n].Cycle, want)
+		}
+	}
+
+	var vcd bytes.Buffer
+	err := a.WriteVCD(&vcd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"$var wire 1 % ATN $end",
+		"#30\n0%\n",
+		"#40\nb00101000 )\n",
+	} {
+		if !strings.Contains(vcd.String(), want) {
+			t.Errorf("VCD does not contain %q", want)
+		}
+	}
+
+	// Nothing is recorded once the analyzer is removed
+	bus.Untap(a)
+	host.Update(func(out *IEEE488) { out.ATN = FALSE })
+	port.Sync()
+	if n := a.Len(); n != 3 {
+		t.Errorf("%d samples after untapping, want 3", n)
+	}
+}
+
+// Changes in the same cycle are written as one block
+func TestAnalyzerVCDSameCycle(t *testing.T) {
+	a := NewAnalyzer()
+	a.sample(10, MakeIEEE488())
+	atn := MakeIEEE488()
+	atn.ATN = TRUE
+	a.sample(20, atn)
+	atn.DIO = 0x28
+	a.sample(20, atn)
+
+	var vcd bytes.Buffer
+	err := a.WriteVCD(&vcd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(vcd.String(), "#20\n"); n != 1 {
+		t.Errorf("%d blocks for cycle 20, want 1", n)
+	}
+	if want := "#20\n0%\nb00101000 )\n"; !strings.Contains(vcd.String(), want) {
+		t.Errorf("VCD does not contain %q", want)
+	}
+}
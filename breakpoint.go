@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Stops waiting to be collected before further stops are dropped
+const STOP_QUEUE = 16
+
+// ErrTopLevel is returned by Finish when there is no routine to return from
+var ErrTopLevel = errors.New("not in a subroutine or interrupt handler")
+
+// Breakpoint pauses the drive when the PC reaches an address & the conditions are true
+type Breakpoint struct {
+	ID         int
+	Address    Word
+	Conditions []Condition
+	Hits       int
+}
+
+func (b Breakpoint) String() string {
+	s := fmt.Sprintf("%d: $%04x", b.ID, b.Address)
+	if len(b.Conditions) > 0 {
+		c := make([]string, len(b.Conditions))
+		for n, cond := range b.Conditions {
+			c[n] = cond.String()
+		}
+		s += " if " + strings.Join(c, " && ")
+	}
+	return fmt.Sprintf("%s (%d hits)", s, b.Hits)
+}
+
+/*
+Condition compares a register or a byte of memory with a value. Registers are
+named a, x, y, s, p & pc; memory is given as an address e.g. $0200.
+*/
+type Condition struct {
+	Register string // Register to compare, or "" to compare memory
+	Address  Word   // Memory to compare
+	Op       string
+	Value    int
+}
+
+var conditionOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+/*
+ParseConditions parses one or more conditions joined by &&, for example:
+
+	a==10 && $0200!=ff
+
+Values & addresses are in hex.
+*/
+func ParseConditions(s string) ([]Condition, error) {
+	var conditions []Condition
+
+	for _, term := range strings.Split(s, "&&") {
+		cond, err := parseCondition(strings.TrimSpace(term))
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, cond)
+	}
+	return conditions, nil
+}
+
+func parseCondition(s string) (Condition, error) {
+	var cond Condition
+
+	for _, op := range conditionOps {
+		left, right, ok := strings.Cut(s, op)
+		if !ok {
+			continue
+		}
+		cond.Op = op
+
+		left = strings.ToLower(strings.TrimSpace(left))
+		switch left {
+		case "a", "x", "y", "s", "p", "pc":
+			cond.Register = left
+		default:
+			if !strings.HasPrefix(left, "$") {
+				return cond, fmt.Errorf("invalid condition %q: expected a register or $address", s)
+			}
+			addr, err := strconv.ParseUint(left[1:], 16, 16)
+			if err != nil {
+				return cond, fmt.Errorf("invalid address %q", left)
+			}
+			cond.Address = Word(addr)
+		}
+
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(right), "$"), 16, 16)
+		if err != nil {
+			return cond, fmt.Errorf("invalid value %q", right)
+		}
+		cond.Value = int(value)
+
+		return cond, nil
+	}
+	return cond, fmt.Errorf("invalid condition %q: no comparison", s)
+}
+
+func (cond Condition) String() string {
+	left := cond.Register
+	if left == "" {
+		left = fmt.Sprintf("$%04x", cond.Address)
+	}
+	return fmt.Sprintf("%s%s$%02x", left, cond.Op, cond.Value)
+}
+
+func (cond Condition) eval(c *CBM2031) bool {
+	var v int
+
+	switch cond.Register {
+	case "a":
+		v = int(c.cpu.Registers.A.Get())
+	case "x":
+		v = int(c.cpu.Registers.X.Get())
+	case "y":
+		v = int(c.cpu.Registers.Y.Get())
+	case "s":
+		v = int(c.cpu.Registers.S.Get())
+	case "p":
+		v = int(c.cpu.Registers.P.GetByte())
+	case "pc":
+		v = int(c.cpu.PC.Get())
+	default:
+		v = int(c.bus.Peek(cond.Address))
+	}
+
+	switch cond.Op {
+	case "==":
+		return v == cond.Value
+	case "!=":
+		return v != cond.Value
+	case "<=":
+		return v <= cond.Value
+	case ">=":
+		return v >= cond.Value
+	case "<":
+		return v < cond.Value
+	case ">":
+		return v > cond.Value
+	}
+	return false
+}
+
+// Stop is sent when the drive pauses itself
+type Stop struct {
+	PC         Word
+	Breakpoint int // ID of the breakpoint that was hit, or 0
+}
+
+func (s Stop) String() string {
+	if s.Breakpoint != 0 {
+		return fmt.Sprintf("breakpoint %d at $%04x", s.Breakpoint, s.PC)
+	}
+	return fmt.Sprintf("stopped at $%04x", s.PC)
+}
+
+// Stops returns a channel that receives a Stop whenever the drive pauses itself
+func (c *CBM2031) Stops() <-chan Stop {
+	return c.stops
+}
+
+// AddBreakpoint sets a breakpoint at address, with optional conditions
+func (c *CBM2031) AddBreakpoint(address Word, conditions []Condition) Breakpoint {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextBreak++
+	b := &Breakpoint{
+		ID:         c.nextBreak,
+		Address:    address,
+		Conditions: conditions,
+	}
+	c.breakpoints = append(c.breakpoints, b)
+
+	return *b
+}
+
+func (c *CBM2031) DeleteBreakpoint(id int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for n, b := range c.breakpoints {
+		if b.ID == id {
+			c.breakpoints = append(c.breakpoints[:n], c.breakpoints[n+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+func (c *CBM2031) Breakpoints() []Breakpoint {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	breakpoints := make([]Breakpoint, len(c.breakpoints))
+	for n, b := range c.breakpoints {
+		breakpoints[n] = *b
+	}
+	return breakpoints
+}
+
+// Check the breakpoints & stop condition after an instruction
+func (c *CBM2031) shouldStop() bool {
+	pc := c.cpu.PC.Get()
+
+	if c.until != nil && c.until() {
+		c.until = nil
+		c.stopped(Stop{PC: pc})
+		return true
+	}
+
+	for _, b := range c.breakpoints {
+		if b.Address != pc {
+			continue
+		}
+
+		hit := true
+		for _, cond := range b.Conditions {
+			if !cond.eval(c) {
+				hit = false
+				break
+			}
+		}
+		if hit {
+			b.Hits++
+			c.until = nil
+			c.stopped(Stop{PC: pc, Breakpoint: b.ID})
+			return true
+		}
+	}
+	return false
+}
+
+// Report a stop, dropping it if nothing is collecting them
+func (c *CBM2031) stopped(s Stop) {
+	select {
+	case c.stops <- s:
+	default:
+	}
+}
+
+/*
+StepOver executes the next instruction. If it is a JSR the subroutine is run
+to completion, & the drive pauses again when it returns (or a breakpoint is
+hit). The drive must be paused, & a Stop is sent when it pauses again.
+*/
+func (c *CBM2031) StepOver(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.running && !c.paused {
+		return ErrRunning
+	}
+
+	n := c.instructions + 1
+	stop := func() bool {
+		return c.instructions >= n
+	}
+
+	pc := c.cpu.PC.Get()
+	if c.bus.Peek(pc) == OPCODE_JSR {
+		ret := pc + 3
+		s := c.cpu.Registers.S.Get()
+		stop = func() bool {
+			return c.cpu.PC.Get() == ret && c.cpu.Registers.S.Get() >= s
+		}
+	}
+	return c.resumeUntil(ctx, stop)
+}
+
+/*
+Finish runs until the current subroutine or interrupt handler returns. The
+drive must be paused, & a Stop is sent when it pauses again.
+*/
+func (c *CBM2031) Finish(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.running && !c.paused {
+		return ErrRunning
+	}
+	if len(c.calls) == 0 {
+		return ErrTopLevel
+	}
+
+	depth := len(c.calls)
+	return c.resumeUntil(ctx, func() bool {
+		return len(c.calls) < depth
+	})
+}
+
+/*
+Resume until stop returns true. If Run is active the drive is resumed & a Stop
+is sent when it pauses; otherwise the instructions are executed before
+returning, unless the context is cancelled first.
+*/
+func (c *CBM2031) resumeUntil(ctx context.Context, stop func() bool) error {
+	c.until = stop
+
+	if c.running {
+		c.paused = false
+		c.resume.Broadcast()
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			c.until = nil
+			return err
+		}
+		err := c.execute()
+		if err != nil {
+			c.until = nil
+			return err
+		}
+		if c.shouldStop() {
+			return nil
+		}
+	}
+}
+
+/*
+Follow calls & returns with a shadow call stack, for Finish. Like the
+profiler's, a routine ends when the stack pointer rises above where it was on
+entry.
+*/
+func (c *CBM2031) trackCalls(opcode Byte) {
+	s := c.cpu.Registers.S.Get()
+	for len(c.calls) > 0 && c.calls[len(c.calls)-1] < s {
+		c.calls = c.calls[:len(c.calls)-1]
+	}
+	if opcode == OPCODE_JSR {
+		c.calls = append(c.calls, s)
+	}
+}
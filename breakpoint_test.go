@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseConditions(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"a==10", "a==$10", false},
+		{"X != $ff", "x!=$ff", false},
+		{"pc>=ec00", "pc>=$ec00", false},
+		{"$0200<3 && y>1", "$0200<$03 && y>$01", false},
+		{"a=10", "", true},
+		{"q==1", "", true},
+		{"a==zz", "", true},
+	}
+
+	for _, tt := range tests {
+		conditions, err := ParseConditions(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.in, err)
+			continue
+		}
+
+		got := Breakpoint{Conditions: conditions}.String()
+		if want := "0: $0000 if " + tt.want + " (0 hits)"; got != want {
+			t.Errorf("%q parsed as %q, want %q", tt.in, got, want)
+		}
+	}
+}
+
+func TestConditionalBreakpoint(t *testing.T) {
+	c := newLoopDrive()
+	conditions, err := ParseConditions("x==5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddBreakpoint(0x301, conditions)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	select {
+	case s := <-c.Stops():
+		if s.Breakpoint != 1 || s.PC != 0x301 {
+			t.Errorf("stopped with %s, want breakpoint 1 at $0301", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("breakpoint was not hit")
+	}
+
+	if !c.Paused() {
+		t.Error("drive is not paused at a breakpoint")
+	}
+	if r := c.Registers(); r.X != 5 {
+		t.Errorf("X = %d at the breakpoint, want 5", r.X)
+	}
+	if b := c.Breakpoints()[0]; b.Hits != 1 {
+		t.Errorf("breakpoint has %d hits, want 1", b.Hits)
+	}
+}
+
+// Create a drive that calls a subroutine at $0310 from $0300
+func newSubroutineDrive() *CBM2031 {
+	c := newLoopDrive()
+
+	program := map[Word][]Byte{
+		0x300: {0x20, 0x10, 0x03, 0xea}, // JSR $0310; NOP
+		0x310: {0xe8, 0xe8, 0x60},       // INX; INX; RTS
+	}
+	for addr, code := range program {
+		for n, b := range code {
+			c.ram.Write(addr+Word(n), b)
+		}
+	}
+	return c
+}
+
+func TestStepOver(t *testing.T) {
+	c := newSubroutineDrive()
+
+	err := c.StepOver(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.Registers(); r.PC != 0x303 || r.X != 2 {
+		t.Errorf("after stepping over JSR: %s, want PC $0303 & X 2", r)
+	}
+
+	err = c.StepOver(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc := c.PC(); pc != 0x304 {
+		t.Errorf("after stepping over NOP: PC $%04x, want $0304", pc)
+	}
+}
+
+func TestFinish(t *testing.T) {
+	c := newSubroutineDrive()
+
+	err := c.Step(2) // JSR; INX
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Finish(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.Registers(); r.PC != 0x303 || r.X != 2 {
+		t.Errorf("after finish: %s, want PC $0303 & X 2", r)
+	}
+}
+
+func TestFinishTopLevel(t *testing.T) {
+	c := newLoopDrive()
+
+	err := c.Finish(context.Background())
+	if err != ErrTopLevel {
+		t.Errorf("finish at the top level returned %v, want ErrTopLevel", err)
+	}
+}
+
+// A subroutine that never returns is abandoned when the context is done
+func TestStepOverNeverReturns(t *testing.T) {
+	c := newSubroutineDrive()
+	for n, b := range []Byte{0x4c, 0x10, 0x03} { // JMP $0310
+		c.ram.Write(0x310+Word(n), b)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := c.StepOver(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("stepping over returned %v, want context.DeadlineExceeded", err)
+	}
+	if pc := c.PC(); pc != 0x310 {
+		t.Errorf("PC $%04x, want $0310", pc)
+	}
+
+	// The abandoned step doesn't stop later execution
+	err = c.Step(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.shouldStop() {
+		t.Error("stopped by the abandoned step")
+	}
+}
@@ -11,11 +11,13 @@ type Device interface {
 	GetBase() Word
 	GetSize() Word
 	CheckInterrupt() bool
+	Peek(Word) Byte // Read without side effects
 	mos6502.ReadWriter
 }
 
 type Bus struct {
 	Devices []Device
+	Trace   *Trace // Records reads & writes, if set
 
 	Writer io.Writer // io.Writer for log output
 }
@@ -33,40 +35,72 @@ func (b *Bus) Map(device Device) {
 	b.Devices = append([]Device{device}, b.Devices...)
 }
 
-func (b *Bus) Read(address Word) Byte {
-	b.debug("read $%04x\n", address)
-
+// Find the device mapped at the given address
+func (b *Bus) device(address Word) Device {
 	for n, d := range b.Devices {
 		base := d.GetBase()
-		size := d.GetSize()
-		top := base + (size - 1)
-
-		b.debug("device %d at $%04x:$%04x\n", n, base, base+top)
+		top := base + (d.GetSize() - 1)
 
+		if b.Writer != nil {
+			b.debug("device %d at $%04x:$%04x\n", n, base, top)
+		}
 		if address >= base && address <= top {
-			b.debug("selected device %d at $%04x\n", n, base)
-			return d.Read(address)
+			if b.Writer != nil {
+				b.debug("selected device %d at $%04x\n", n, base)
+			}
+			return d
 		}
 	}
-	return Byte(0)
+	return nil
+}
+
+func (b *Bus) Read(address Word) Byte {
+	if b.Writer != nil {
+		b.debug("read $%04x\n", address)
+	}
+
+	var data Byte
+	if d := b.device(address); d != nil {
+		data = d.Read(address)
+	}
+	if b.Trace != nil {
+		b.Trace.access(address, data, false)
+	}
+	return data
 }
 
 func (b *Bus) Write(address Word, data Byte) {
-	b.debug("write $%04x\n", address)
+	if b.Writer != nil {
+		b.debug("write $%04x\n", address)
+	}
+	if b.Trace != nil {
+		b.Trace.access(address, data, true)
+	}
 
 	for n, d := range b.Devices {
 		base := d.GetBase()
-		size := d.GetSize()
-		top := base + (size - 1)
+		top := base + (d.GetSize() - 1)
 
-		b.debug("device %d at $%04x:$%04x\n", n, base, base+top)
+		if b.Writer != nil {
+			b.debug("device %d at $%04x:$%04x\n", n, base, top)
+		}
 		if address >= base && address <= top {
-			b.debug("selected device %d at $%04x\n", n, base)
+			if b.Writer != nil {
+				b.debug("selected device %d at $%04x\n", n, base)
+			}
 			d.Write(address, data)
 		}
 	}
 }
 
+// Peek reads from the bus without triggering any side effects in the device
+func (b *Bus) Peek(address Word) Byte {
+	if d := b.device(address); d != nil {
+		return d.Peek(address)
+	}
+	return Byte(0)
+}
+
 func (b *Bus) CheckInterrupts() bool {
 	// Check devices for interrupts
 	for _, d := range b.Devices {
@@ -1,28 +1,43 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"sync"
 
 	"github.com/vanders/pet/mos6502"
 )
 
 type CBM2031Connector struct {
-	Via *VIA
+	Via    *VIA
+	Device int // Device number selected by the jumpers
 }
 
 func (c CBM2031Connector) Read() IEEE488 {
+	return c.outputs(c.Via.CtrlPeek(CTRL_CA1))
+}
+
+/*
+ReadATN returns the outputs with ATN released & with it asserted. The ATN
+acknowledge gates answer ATN without waiting for the CPU, so the bus works out
+NDAC & NRFD from ATN as it is now.
+*/
+func (c CBM2031Connector) ReadATN() (released, asserted IEEE488) {
+	return c.outputs(false), c.outputs(true)
+}
+
+// The outputs to the bus when CA1, the inverse of ATN, is at the given level
+func (c CBM2031Connector) outputs(ca1 bool) IEEE488 {
 	var (
 		portA, portB, portADir, portBDir Byte
-		ca1                              bool
 		out                              IEEE488
 	)
 
 	out = MakeIEEE488()
 	portA = c.Via.Out(PORT_A)
 	portADir = c.Via.PeekRegister(PORT_A_DIR)
-	ca1 = c.Via.CtrlPeek(CTRL_CA1)
 	portB = c.Via.Out(PORT_B)
 	portBDir = c.Via.PeekRegister(PORT_B_DIR)
 
@@ -47,53 +62,27 @@ func (c CBM2031Connector) Read() IEEE488 {
 	}
 
 	/* Convert TTL to IEEE488 */
-	if portBDir&mos6502.BIT_1 == 0 {
-		// NRFD is an input
-		out.NRFD = FLOATING
-	} else {
-		if nrfd {
-			out.NRFD = FALSE
-		} else {
-			out.NRFD = TRUE
-		}
-	}
-	if portBDir&mos6502.BIT_2 == 0 {
-		// NDAC is an input
-		out.NRFD = FLOATING
-	} else {
-		if ndac {
-			out.NDAC = FALSE
-		} else {
-			out.NDAC = TRUE
-		}
-	}
-
-	if portBDir&mos6502.BIT_3 == 0 {
-		// EOI is an input
-		out.EOI = FLOATING
-	} else {
-		if portB&mos6502.BIT_3 != 0 {
-			out.EOI = FALSE
-		} else {
-			out.EOI = TRUE
-		}
-	}
-	if portBDir&mos6502.BIT_6 == 0 {
-		// DAV is an input
-		out.DAV = FLOATING
-	} else {
-		if portB&mos6502.BIT_6 != 0 {
-			out.DAV = FALSE
-		} else {
-			out.DAV = TRUE
-		}
-	}
+	out.NRFD = driven(nrfd, portBDir&mos6502.BIT_1 != 0)
+	out.NDAC = driven(ndac, portBDir&mos6502.BIT_2 != 0)
+	out.EOI = driven(portB&mos6502.BIT_3 != 0, portBDir&mos6502.BIT_3 != 0)
+	out.DAV = driven(portB&mos6502.BIT_6 != 0, portBDir&mos6502.BIT_6 != 0)
 
-	out.DIO = portA & portADir
+	out.DIO = DIOFromTTL(portA, portADir)
 
 	return out
 }
 
+/*
+The line driven by a port pin. A pin that is an input doesn't drive the line
+at all; an output asserts it when the pin is low.
+*/
+func driven(ttl, output bool) IEEEBool {
+	if !output {
+		return FLOATING
+	}
+	return IEEEBoolFromBool(!ttl)
+}
+
 func (c CBM2031Connector) Write(i IEEE488) {
 	var (
 		TTL   bool
@@ -137,25 +126,100 @@ func (c CBM2031Connector) Write(i IEEE488) {
 		portB |= mos6502.BIT_6
 	}
 
-	c.Via.In(PORT_A, i.DIO)
+	/*
+		The device number jumpers are read through PB0 & PB1 while CA2 is
+		driven low, which the ROM does once at reset
+	*/
+	if c.Via.ca2Mode() >= CTRL_HANDSHAKE && !c.Via.CtrlOut(CTRL_CA2) {
+		portB &^= mos6502.BIT_0 | mos6502.BIT_1
+		portB |= Byte(c.Device-MIN_DEVICE) & (mos6502.BIT_0 | mos6502.BIT_1)
+	}
+
+	/*
+		SRQ & REN aren't connected, so the drive never requests service & ignores
+		remote enable. IFC is wired to the reset line, which is handled by the
+		drive as it syncs the bus.
+	*/
+
+	c.Via.In(PORT_A, DIOToTTL(i.DIO))
 	c.Via.In(PORT_B, portB) // Port B
 }
 
 type CBM2031 struct {
-	Cable *Cable
-	VIA   *VIA
-	RAM   *RAM
+	VIA      *VIA
+	RAM      *RAM
+	Throttle *Throttle
+
+	CrashReport string // Written when execution stops on an error, if set
+
+	device    int      // Device number set by the jumpers
+	port      *BusPort // Connection to the IEEE488 bus
+	cpu       *mos6502.CPU
+	bus       *Bus
+	scheduler *Scheduler
+	via1      *VIA
+	via2      *VIA
+	ram       *RAM
+	hiRom     *ROM
+	loRom     *ROM
+	romHash   string // Identifies the ROM contents, including any patches
+
+	trace        *Trace
+	isr          bool    // The CPU is handling an interrupt
+	held         bool    // IFC is holding the drive in reset
+	lines        IEEE488 // Lines on the bus as last delivered to the drive
+	calls        []Byte  // Stack pointer on entry to each routine being run
+	instructions uint64
+	history      *History
+	profiler     *Profiler
+	breakpoints  []*Breakpoint
+	nextBreak    int         // ID of the next breakpoint
+	until        func() bool // Pause when this returns true
+	stops        chan Stop
+
+	mutex   sync.Mutex // Held while instructions are executed
+	resume  *sync.Cond
+	running bool
+	paused  bool
+}
+
+// Device numbers that can be selected with the jumpers
+const (
+	MIN_DEVICE     = 8
+	MAX_DEVICE     = 11
+	DEFAULT_DEVICE = MIN_DEVICE
+)
+
+var (
+	ErrRunning = errors.New("drive is running") // The drive must be paused for the operation
+	ErrJAM     = errors.New("CPU jammed")       // A JAM opcode was executed
+)
 
-	cpu   *mos6502.CPU
-	bus   *Bus
-	via1  *VIA
-	via2  *VIA
-	ram   *RAM
-	hiRom *ROM
-	loRom *ROM
+// ExecutionError is returned when the CPU stops on an instruction
+type ExecutionError struct {
+	PC     Word
+	Err    error
+	Report string // Crash report file, if one was written
 }
 
-func NewCBM2031(writer io.Writer) *CBM2031 {
+func (e *ExecutionError) Error() string {
+	return fmt.Sprintf("execution stopped at $%04x: %s", e.PC, e.Err)
+}
+
+func (e *ExecutionError) Unwrap() error {
+	return e.Err
+}
+
+/*
+NewCBM2031 creates a drive that responds to the device number, which must be
+between MIN_DEVICE & MAX_DEVICE. Disassembly is written to writer if it is
+not nil.
+*/
+func NewCBM2031(writer io.Writer, device int) (*CBM2031, error) {
+	if device < MIN_DEVICE || device > MAX_DEVICE {
+		return nil, fmt.Errorf("device number %d is not between %d and %d", device, MIN_DEVICE, MAX_DEVICE)
+	}
+
 	// Create a new memory bus
 	bus := &Bus{}
 
@@ -186,67 +250,562 @@ func NewCBM2031(writer io.Writer) *CBM2031 {
 	hiRom.Load("roms/901484-05.bin")
 	bus.Map(hiRom)
 
+	// The VIAs are clocked by the scheduler
+	scheduler := &Scheduler{}
+
 	// VIA1
 	via1 := &VIA{
 		Base: 0x1800,
 	}
-	bus.Map(via1)
+	scheduler.Add(via1)
+	bus.Map(ScheduledDevice{via1, scheduler})
 
 	// VIA2
 	via2 := &VIA{
 		Base: 0x1c00,
 	}
-	bus.Map(via2)
+	scheduler.Add(via2)
+	bus.Map(ScheduledDevice{via2, scheduler})
+
+	// Keep a trace of the recent instructions & bus accesses
+	trace := &Trace{}
+	bus.Trace = trace
 
 	cpu := mos6502.NewCPU(bus.Read, bus.Write, nil, writer)
 	cpu.Reset()
 
-	return &CBM2031{
-		cpu:   cpu,
-		bus:   bus,
-		via1:  via1,
-		VIA:   via1,
-		via2:  via2,
-		ram:   ram,
-		RAM:   ram,
-		hiRom: hiRom,
-		loRom: loRom,
+	c := &CBM2031{
+		device:    device,
+		cpu:       cpu,
+		bus:       bus,
+		scheduler: scheduler,
+		via1:      via1,
+		VIA:       via1,
+		via2:      via2,
+		ram:       ram,
+		RAM:       ram,
+		Throttle:  &Throttle{},
+		trace:     trace,
+		lines:     MakeIEEE488(),
+		stops:     make(chan Stop, STOP_QUEUE),
+		hiRom:     hiRom,
+		loRom:     loRom,
 	}
+	c.resume = sync.NewCond(&c.mutex)
+	c.romHash = c.hashROMs()
+
+	return c, nil
 }
 
 // Create a new IEEE488 connector
 func (c *CBM2031) CreateConnector() *CBM2031Connector {
 	return &CBM2031Connector{
-		Via: c.via1,
+		Via:    c.via1,
+		Device: c.device,
 	}
 }
 
-func (c *CBM2031) Run() {
-	// Run the CPU
+// Device returns the device number the drive responds to
+func (c *CBM2031) Device() int {
+	return c.device
+}
+
+// Connect the drive to an IEEE488 bus, which it syncs after every instruction
+func (c *CBM2031) Connect(bus *IEEEBus) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.port = bus.Connect(c.CreateConnector())
+	c.port.Clock = c.scheduler.Now
+}
+
+/*
+Apply patches to the ROMs. Every patch is checked against copies of the ROMs
+first, so if any of them doesn't match nothing is applied. The CPU is reset
+afterwards so that any patched vectors take effect.
+*/
+func (c *CBM2031) ApplyPatches(patches []Patch) error {
+	lo, hi := c.loRom.Copy(), c.hiRom.Copy()
+
+	for _, p := range patches {
+		var rom *ROM
+
+		switch {
+		case lo.Contains(p.Address):
+			rom = lo
+		case hi.Contains(p.Address):
+			rom = hi
+		default:
+			return fmt.Errorf("patch $%04x: address is not in ROM", p.Address)
+		}
+
+		err := rom.Patch(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Everything matched
+	c.loRom.mem, c.hiRom.mem = lo.mem, hi.mem
+	c.romHash = c.hashROMs()
+	c.cpu.Reset()
+
+	return nil
+}
+
+/*
+Run executes instructions until the context is cancelled or the CPU stops with
+an error. The drive can be paused, stepped & resumed from other goroutines
+while Run is active.
+*/
+func (c *CBM2031) Run(ctx context.Context) error {
+	return c.run(ctx, nil)
+}
+
+// RunUntil executes instructions until the PC reaches address
+func (c *CBM2031) RunUntil(ctx context.Context, address Word) error {
+	return c.run(ctx, func() bool {
+		return c.cpu.PC.Get() == address
+	})
+}
+
+func (c *CBM2031) run(ctx context.Context, until func() bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.running {
+		return ErrRunning
+	}
+	c.running = true
+	defer func() {
+		c.running = false
+	}()
+
+	// Wake the loop if the context is cancelled while paused
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mutex.Lock()
+			c.resume.Broadcast()
+			c.mutex.Unlock()
+		case <-done:
+		}
+	}()
+
 	for {
-		// Execute a single instruction
-		err := c.cpu.Step()
+		if c.paused {
+			// Pacing starts afresh on resume
+			c.Throttle.Restart()
+		}
+		for c.paused && ctx.Err() == nil {
+			c.resume.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := c.Cycles()
+		for c.Cycles()-start < THROTTLE_INTERVAL {
+			err := c.execute()
+			if err != nil {
+				return err
+			}
+			if until != nil && until() {
+				return nil
+			}
+			if c.shouldStop() {
+				c.paused = true
+				break
+			}
+		}
+
+		// Give other goroutines a chance to pause the drive while it's paced
+		now := c.Cycles()
+		c.mutex.Unlock()
+		c.Throttle.Pace(now)
+		c.mutex.Lock()
+	}
+}
+
+/*
+Pause stops execution between instructions. When Pause returns no further
+instructions will be executed by Run until Resume is called.
+*/
+func (c *CBM2031) Pause() {
+	c.mutex.Lock()
+	c.paused = true
+	c.mutex.Unlock()
+}
+
+// Resume continues execution after Pause
+func (c *CBM2031) Resume() {
+	c.mutex.Lock()
+	c.until = nil
+	c.paused = false
+	c.resume.Broadcast()
+	c.mutex.Unlock()
+}
+
+func (c *CBM2031) Paused() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.paused
+}
+
+// Step executes n instructions. The drive must be paused or not running.
+func (c *CBM2031) Step(n int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.running && !c.paused {
+		return ErrRunning
+	}
+	for ; n > 0; n-- {
+		err := c.execute()
 		if err != nil {
-			dumpAndExit(c.cpu, c.ram, fmt.Errorf("\nexecution stopped: %s", err))
+			return err
+		}
+	}
+	return nil
+}
+
+// Execute one instruction, then clock the peripherals & handle interrupts
+func (c *CBM2031) execute() error {
+	if c.held {
+		c.holdReset()
+		return nil
+	}
+
+	pc := c.cpu.PC.Get()
+	cycles, err := c.step()
+	if err != nil {
+		e := &ExecutionError{PC: pc, Err: err}
+		if c.CrashReport != "" && c.crashReport(c.CrashReport, e) == nil {
+			e.Report = c.CrashReport
+		}
+		return e
+	}
+	c.clock(cycles)
+	c.trackCalls(c.cpu.IR.Get())
+
+	c.instructions++
+	replaying := c.history != nil && c.history.replaying(c.instructions)
+
+	// Re-executed instructions have already been profiled
+	profile := c.profiler != nil && !replaying
+	if profile {
+		c.profiler.instruction(pc, c.cpu.IR.Get(), cycles, c.cpu.PC.Get(), c.cpu.Registers.S.Get())
+	}
+
+	// Sync data on the IEEE488 interface
+	c.scheduler.Touch(c.via1)
+	if c.syncBus().IFC == TRUE {
+		c.reset()
+		c.held = true
+		return nil
+	}
+
+	// Check devices for interrupts
+	if c.bus.CheckInterrupts() {
+		cycles := c.interrupt()
+		c.clock(cycles)
+		if cycles != 0 {
+			c.calls = append(c.calls, c.cpu.Registers.S.Get())
 		}
+		if profile && cycles != 0 {
+			c.profiler.interrupt(c.cpu.PC.Get(), cycles, c.cpu.Registers.S.Get())
+		}
+	}
+
+	if h := c.history; h != nil && !replaying {
+		last := h.checkpoints[len(h.checkpoints)-1].snapshot.Cycles
+		if c.Cycles()-last >= CHECKPOINT_INTERVAL {
+			c.checkpoint()
+		}
+	}
+	return nil
+}
+
+/*
+While IFC is asserted the drive is held in reset, & is checked again after
+every cycle. Each cycle counts as an instruction so that history replays the
+bus at the same points.
+*/
+func (c *CBM2031) holdReset() {
+	c.clock(1)
+	c.instructions++
+
+	c.scheduler.Touch(c.via1)
+	c.held = c.syncBus().IFC == TRUE
+}
+
+// InReset returns true while IFC is holding the drive in reset
+func (c *CBM2031) InReset() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.held
+}
 
-		c.via1.Clock()
-		c.via2.Clock()
+// Reset the CPU & the VIAs, as if the reset line was pulled low
+func (c *CBM2031) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-		// Sync data on the IEEE488 interface
-		c.Cable.Sync()
+	c.reset()
+}
+
+func (c *CBM2031) reset() {
+	c.newCPU(false)
+	c.calls = nil
+	c.cpu.Reset()
+
+	for _, via := range []*VIA{c.via1, c.via2} {
+		c.scheduler.Touch(via)
+		via.Reset()
+	}
+}
+
+/*
+Replace the CPU with one that is or isn't handling an interrupt. The CPU only
+leaves its interrupt handler with an RTI & only enters it by taking an
+interrupt, so a new CPU is the way to clear it. To set it the new CPU takes an
+interrupt against a dummy bus, so that memory isn't touched. Registers must be
+set by the caller.
+*/
+func (c *CBM2031) newCPU(isr bool) {
+	cpu := mos6502.NewCPU(func(Word) Byte { return 0 }, func(Word, Byte) {}, nil, nil)
+	cpu.Reset()
+	if isr {
+		cpu.Registers.P.I = false
+		cpu.Interrupt()
+	}
+
+	cpu.BusRead, cpu.BusWrite, cpu.Writer = c.bus.Read, c.bus.Write, c.cpu.Writer
+	c.cpu = cpu
+	c.isr = isr
+}
+
+// PC returns the address of the next instruction
+func (c *CBM2031) PC() Word {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.cpu.PC.Get()
+}
+
+// Peek reads drive memory without side effects
+func (c *CBM2031) Peek(address Word) Byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.bus.Peek(address)
+}
+
+/*
+Poke writes to drive memory, as the CPU would but without tracing the access.
+The history is discarded, as re-execution wouldn't repeat the write.
+*/
+func (c *CBM2031) Poke(address Word, data Byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if d := c.bus.device(address); d != nil {
+		d.Write(address, data)
+	}
+	c.restartHistory()
+}
+
+// PeekVIA reads a register of the VIA connected to the IEEE488 bus without side effects
+func (c *CBM2031) PeekVIA(r VIARegister) Byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.scheduler.Touch(c.via1)
+	return c.via1.PeekRegister(r)
+}
+
+// VIAInterrupt returns true if the VIA connected to the IEEE488 bus is interrupting
+func (c *CBM2031) VIAInterrupt() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.scheduler.Touch(c.via1)
+	return c.via1.CheckInterrupt()
+}
 
-		// Check devices for interrupts
-		if c.bus.CheckInterrupts() {
-			c.cpu.Interrupt()
+// Registers returns the current state of the CPU
+func (c *CBM2031) Registers() CPUState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.registers()
+}
+
+func (c *CBM2031) registers() CPUState {
+	return CPUState{
+		A:   c.cpu.Registers.A.Get(),
+		X:   c.cpu.Registers.X.Get(),
+		Y:   c.cpu.Registers.Y.Get(),
+		S:   c.cpu.Registers.S.Get(),
+		P:   c.cpu.Registers.P.GetByte(),
+		PC:  c.cpu.PC.Get(),
+		ISR: c.isr,
+	}
+}
+
+// Status register flags, which can be set individually with SetRegister
+var flagBits = map[string]Byte{
+	"n": 0x80,
+	"v": 0x40,
+	"b": 0x10,
+	"d": 0x08,
+	"i": 0x04,
+	"z": 0x02,
+	"c": 0x01,
+}
+
+/*
+SetRegister changes a register (a, x, y, s, p or pc) or a single flag of the
+status register (n, v, b, d, i, z or c). Any history recorded so far is
+discarded, as re-executing it wouldn't include the change.
+*/
+func (c *CBM2031) SetRegister(name string, value Word) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if bit, ok := flagBits[name]; ok {
+		if value > 1 {
+			return fmt.Errorf("flag %s must be 0 or 1", name)
+		}
+		p := c.cpu.Registers.P.GetByte() &^ bit
+		if value == 1 {
+			p |= bit
 		}
+		c.cpu.Registers.P.SetByte(p)
+		c.restartHistory()
+		return nil
+	}
+
+	if name != "pc" && value > 0xff {
+		return fmt.Errorf("register %s is 8 bits", name)
+	}
+	switch name {
+	case "a":
+		c.cpu.Registers.A.Set(Byte(value))
+	case "x":
+		c.cpu.Registers.X.Set(Byte(value))
+	case "y":
+		c.cpu.Registers.Y.Set(Byte(value))
+	case "s":
+		c.cpu.Registers.S.Set(Byte(value))
+	case "p":
+		c.cpu.Registers.P.SetByte(Byte(value))
+	case "pc":
+		c.cpu.PC.Set(value)
+	default:
+		return fmt.Errorf("unknown register %q", name)
+	}
+
+	// Replaying the history would undo the change
+	c.restartHistory()
+	return nil
+}
+
+// Cycles returns the number of clock cycles since reset
+func (c *CBM2031) Cycles() uint64 {
+	return c.scheduler.Now()
+}
+
+// Execute a single instruction & return the number of cycles it took
+func (c *CBM2031) step() (int, error) {
+	pc := c.cpu.PC.Get()
+	opcode := c.bus.Peek(pc)
+	cycles := c.instructionCycles(pc, opcode)
+
+	c.trace.instruction(c.Cycles(), c.cpu, opcode, false)
+	if isJAM(opcode) {
+		return 0, ErrJAM
+	}
+	if isBranch(opcode) && branchTaken(opcode, c.cpu.Registers.P) {
+		cycles += branchCycles(pc, c.bus.Peek(pc+1))
+	}
+
+	err := c.cpu.Step()
+	if err != nil {
+		return 0, err
+	}
+
+	if opcode == OPCODE_RTI {
+		c.isr = false
 	}
+	return cycles, nil
 }
 
-func dumpAndExit(cpu *mos6502.CPU, ram *RAM, err error) {
-	fmt.Println(err)
-	dump(cpu, ram)
-	os.Exit(1)
+// Raise an interrupt & return the number of cycles taken to enter the handler
+func (c *CBM2031) interrupt() int {
+	pc := c.cpu.PC.Get()
+	if !c.cpu.Registers.P.I && !c.isr {
+		c.trace.instruction(c.Cycles(), c.cpu, 0, true)
+	}
+	c.cpu.Interrupt()
+
+	// The CPU ignores the interrupt if it is masked
+	if c.cpu.PC.Get() == pc {
+		return 0
+	}
+	c.isr = true
+	return INTERRUPT_CYCLES
+}
+
+// Calculate the cycles for the instruction at pc, before any branch is taken
+func (c *CBM2031) instructionCycles(pc Word, opcode Byte) int {
+	var (
+		base  Word
+		index Byte
+	)
+
+	cycles := opcodeCycles[opcode]
+
+	switch pageCrossIndex(opcode) {
+	case INDEX_ABSOLUTE_X:
+		base = c.peekWord(pc + 1)
+		index = c.cpu.Registers.X.Get()
+	case INDEX_ABSOLUTE_Y:
+		base = c.peekWord(pc + 1)
+		index = c.cpu.Registers.Y.Get()
+	case INDEX_INDIRECT_Y:
+		zp := c.bus.Peek(pc + 1)
+		base = Word(c.bus.Peek(Word(zp+1)))<<8 | Word(c.bus.Peek(Word(zp)))
+		index = c.cpu.Registers.Y.Get()
+	default:
+		return cycles
+	}
+
+	if (base+Word(index))&0xff00 != base&0xff00 {
+		cycles++
+	}
+	return cycles
+}
+
+func (c *CBM2031) peekWord(address Word) Word {
+	return Word(c.bus.Peek(address+1))<<8 | Word(c.bus.Peek(address))
+}
+
+// Clock the peripherals for the given number of cycles
+func (c *CBM2031) clock(cycles int) {
+	c.scheduler.Advance(cycles)
+}
+
+// Dump writes the CPU registers & the zero page to the CPU's writer
+func (c *CBM2031) Dump() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	dump(c.cpu, c.ram)
 }
 
 func dump(cpu *mos6502.CPU, ram *RAM) {
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Create a drive for a device number that's known to be valid
+func mustNewCBM2031(device int) *CBM2031 {
+	c, err := NewCBM2031(nil, device)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Create a drive running a loop that increments X at $0300
+func newLoopDrive() *CBM2031 {
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+	c.Throttle.SetWarp(true)
+
+	for n, b := range []Byte{0xe8, 0x4c, 0x00, 0x03} { // INX; JMP $0300
+		c.ram.Write(0x300+Word(n), b)
+	}
+	c.cpu.PC.Set(0x300)
+	c.cpu.Registers.X.Set(0)
+
+	return c
+}
+
+func TestStep(t *testing.T) {
+	c := newLoopDrive()
+
+	err := c.Step(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := c.cpu.Registers.X.Get(); x != 3 {
+		t.Errorf("X = %d after 5 steps, want 3", x)
+	}
+	if pc := c.cpu.PC.Get(); pc != 0x301 {
+		t.Errorf("PC = $%04x after 5 steps, want $0301", pc)
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	c := newLoopDrive()
+
+	err := c.RunUntil(context.Background(), 0x301)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc := c.cpu.PC.Get(); pc != 0x301 {
+		t.Errorf("PC = $%04x, want $0301", pc)
+	}
+}
+
+func TestPauseStepResume(t *testing.T) {
+	c := newLoopDrive()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	// Wait for Run to start
+	for c.Step(0) == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Pause()
+	x := c.cpu.Registers.X.Get()
+	time.Sleep(10 * time.Millisecond)
+	if got := c.cpu.Registers.X.Get(); got != x {
+		t.Errorf("X changed from %d to %d while paused", x, got)
+	}
+
+	err := c.Step(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Resume()
+	if err := c.Step(1); !errors.Is(err, ErrRunning) {
+		t.Errorf("Step while running returned %v, want ErrRunning", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not stop when cancelled")
+	}
+}
+
+func TestCancelWhilePaused(t *testing.T) {
+	c := newLoopDrive()
+	c.Pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not stop when cancelled")
+	}
+}
+
+func TestExecutionError(t *testing.T) {
+	c := newLoopDrive()
+	c.ram.Write(0x300, 0x02) // Not a valid opcode
+
+	err := c.Run(context.Background())
+
+	var execErr *ExecutionError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("Run returned %v, want an ExecutionError", err)
+	}
+	if execErr.PC != 0x300 {
+		t.Errorf("error PC = $%04x, want $0300", execErr.PC)
+	}
+}
+
+func TestSetRegister(t *testing.T) {
+	c := newLoopDrive()
+
+	for _, r := range []struct {
+		name  string
+		value Word
+	}{{"pc", 0x0310}, {"a", 0x12}, {"x", 0x34}, {"y", 0x56}, {"s", 0x78}, {"p", 0x00}, {"c", 1}, {"n", 1}} {
+		err := c.SetRegister(r.name, r.value)
+		if err != nil {
+			t.Fatalf("%s: %s", r.name, err)
+		}
+	}
+
+	want := CPUState{PC: 0x310, A: 0x12, X: 0x34, Y: 0x56, S: 0x78, P: 0x81}
+	if got := c.Registers(); got != want {
+		t.Errorf("registers = %s, want %s", got, want)
+	}
+
+	for _, bad := range []struct {
+		name  string
+		value Word
+	}{{"a", 0x100}, {"c", 2}, {"q", 0}} {
+		if err := c.SetRegister(bad.name, bad.value); err == nil {
+			t.Errorf("%s=%x: expected an error", bad.name, bad.value)
+		}
+	}
+}
+
+func TestDeviceNumber(t *testing.T) {
+	bus := &IEEEBus{}
+
+	for device := MIN_DEVICE; device <= MAX_DEVICE; device++ {
+		c := mustNewCBM2031(device)
+		c.Throttle.SetWarp(true)
+		c.Connect(bus)
+
+		// Run the reset code until the talk & listen addresses are set
+		err := c.RunUntil(context.Background(), 0xeb93)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if talk := c.Peek(0x78); talk != Byte(0x40+device) {
+			t.Errorf("device %d: talk address $%02x, want $%02x", device, talk, 0x40+device)
+		}
+		if listen := c.Peek(0x77); listen != Byte(0x20+device) {
+			t.Errorf("device %d: listen address $%02x, want $%02x", device, listen, 0x20+device)
+		}
+	}
+}
+
+func TestDeviceNumberWithoutBus(t *testing.T) {
+	c := mustNewCBM2031(MIN_DEVICE + 1)
+	c.Throttle.SetWarp(true)
+
+	err := c.RunUntil(context.Background(), 0xeb93)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if talk := c.Peek(0x78); talk != Byte(0x40+MIN_DEVICE+1) {
+		t.Errorf("talk address $%02x, want $%02x", talk, 0x40+MIN_DEVICE+1)
+	}
+	if listen := c.Peek(0x77); listen != Byte(0x20+MIN_DEVICE+1) {
+		t.Errorf("listen address $%02x, want $%02x", listen, 0x20+MIN_DEVICE+1)
+	}
+}
+
+func TestInvalidDeviceNumber(t *testing.T) {
+	for _, device := range []int{0, MIN_DEVICE - 1, MAX_DEVICE + 1, 30} {
+		if _, err := NewCBM2031(nil, device); err == nil {
+			t.Errorf("device %d: expected an error", device)
+		}
+	}
+}
+
+func TestIFCReset(t *testing.T) {
+	c := newLoopDrive()
+	c.via1.WriteRegister(PORT_B_DIR, 0xff)
+
+	bus := &IEEEBus{}
+	host := &DummyConnector{}
+	host.Reset()
+	bus.Attach(host)
+	c.Connect(bus)
+
+	reset := Word(c.bus.Peek(0xfffc)) | Word(c.bus.Peek(0xfffd))<<8
+
+	// Reset leaves the interrupt handler
+	c.cpu.Registers.P.I = false
+	if c.interrupt() == 0 {
+		t.Fatal("interrupt not taken")
+	}
+
+	host.Update(func(out *IEEE488) { out.IFC = TRUE })
+	c.Step(10)
+	if !c.InReset() {
+		t.Fatal("drive is not held in reset while IFC is asserted")
+	}
+	if c.Registers().ISR {
+		t.Error("still handling an interrupt after reset")
+	}
+	if pc := c.cpu.PC.Get(); pc != reset {
+		t.Errorf("PC = $%04x while held in reset, want $%04x", pc, reset)
+	}
+	if dir := c.via1.PeekRegister(PORT_B_DIR); dir != 0 {
+		t.Errorf("VIA1 port B direction $%02x, want $00 after reset", dir)
+	}
+
+	host.Update(func(out *IEEE488) { out.IFC = FALSE })
+	c.Step(2)
+	if c.InReset() {
+		t.Fatal("drive still held in reset after IFC was released")
+	}
+	if pc := c.cpu.PC.Get(); pc == reset {
+		t.Error("drive did not start executing after IFC was released")
+	}
+
+	// The CPU takes interrupts again
+	c.cpu.Registers.P.I = false
+	if c.interrupt() == 0 {
+		t.Error("interrupts are still masked by the handler after reset")
+	}
+}
+
+// The monitor reads & writes the drive while it runs in another goroutine
+func TestPeekPokeWhileRunning(t *testing.T) {
+	c := newLoopDrive()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+
+	for n := 0; n < 100; n++ {
+		c.Poke(0x0400, Byte(n))
+		if got := c.Peek(0x0400); got != Byte(n) {
+			t.Errorf("$0400 = $%02x, want $%02x", got, n)
+		}
+		c.PeekVIA(TIMER_1_LOW)
+		c.VIAInterrupt()
+	}
+
+	cancel()
+	if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+		t.Error(err)
+	}
+}
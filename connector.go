@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+DummyConnector is a participant on the bus that isn't emulated, such as the
+monitor's controller. Its outputs are set with Update & the bus delivers the
+state of the lines when it is synced.
+
+The bus is synced from the drive's goroutine, so the lines are only touched
+with the mutex held. Wait & WaitSyncs block until a sync changes the lines,
+rather than polling them. Wait only looks at lines that were worked out from
+the latest outputs, so it never sees the bus as it was before an Update.
+*/
+type DummyConnector struct {
+	mutex   sync.Mutex
+	in      IEEE488
+	out     IEEE488
+	syncs   uint64        // Number of times the bus has been synced
+	changed chan struct{} // Closed at the next sync, if anyone is waiting for it
+
+	generation uint64 // Incremented by each Update
+	read       uint64 // Generation of the outputs the bus last read
+	delivered  uint64 // Generation of the outputs that in was worked out from
+}
+
+func (c *DummyConnector) Reset() {
+	c.Update(func(out *IEEE488) {
+		out.DAV = FLOATING
+		out.EOI = FLOATING
+		out.NDAC = FLOATING
+		out.NRFD = FLOATING
+		out.SRQ = FLOATING
+		out.ATN = FLOATING
+		out.REN = FLOATING
+		out.IFC = FLOATING
+	})
+}
+
+// Read returns the outputs to the bus
+func (c *DummyConnector) Read() IEEE488 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.read = c.generation
+	return c.out
+}
+
+// Write delivers the state of the bus & wakes anything waiting for it
+func (c *DummyConnector) Write(i IEEE488) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.in = i
+	c.delivered = c.read
+	c.syncs++
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// In returns the state of the bus at the last sync
+func (c *DummyConnector) In() IEEE488 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.in
+}
+
+// Out returns the lines the connector drives
+func (c *DummyConnector) Out() IEEE488 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.out
+}
+
+// Update changes the outputs. The bus sees all of the changes at once.
+func (c *DummyConnector) Update(update func(out *IEEE488)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	update(&c.out)
+	c.generation++
+}
+
+/*
+Wait blocks until ok is true of the lines, or the timeout expires. It returns
+the lines as they were when it stopped waiting & whether ok was true.
+*/
+func (c *DummyConnector) Wait(timeout time.Duration, ok func(IEEE488) bool) (IEEE488, bool) {
+	var lines IEEE488
+	done := c.wait(timeout, func() bool {
+		lines = c.in
+		return c.delivered == c.generation && ok(lines)
+	})
+	return lines, done
+}
+
+// WaitSyncs blocks until the bus has been synced n more times, or the timeout expires
+func (c *DummyConnector) WaitSyncs(n uint64, timeout time.Duration) bool {
+	c.mutex.Lock()
+	syncs := c.syncs + n
+	c.mutex.Unlock()
+
+	return c.wait(timeout, func() bool {
+		return c.syncs >= syncs
+	})
+}
+
+// Wait for done to be true, checking it with the mutex held after each sync
+func (c *DummyConnector) wait(timeout time.Duration, done func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for !done() {
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+
+		c.mutex.Unlock()
+		select {
+		case <-changed:
+			c.mutex.Lock()
+		case <-timer.C:
+			c.mutex.Lock()
+			return done()
+		}
+	}
+	return true
+}
+
+func (c *DummyConnector) Dump() {
+	in, out := c.In(), c.Out()
+
+	fmt.Println("IN")
+	fmt.Printf("ATN: %s, NRFD: %s, NDAC: %s, EOI: %s, DAV: %s\n",
+		in.ATN.ToOnOff(),
+		in.NRFD.ToOnOff(),
+		in.NDAC.ToOnOff(),
+		in.EOI.ToOnOff(),
+		in.DAV.ToOnOff())
+	fmt.Printf("DATA: 0x%02x\n", in.DIO)
+	fmt.Printf("REN: %s, SRQ: %s, IFC: %s\n", in.REN.ToOnOff(), in.SRQ.ToOnOff(), in.IFC.ToOnOff())
+	fmt.Println("")
+	fmt.Println("OUT")
+	fmt.Printf("ATN: %s, NRFD: %s, NDAC: %s, EOI: %s, DAV: %s\n",
+		out.ATN.ToOnOff(),
+		out.NRFD.ToOnOff(),
+		out.NDAC.ToOnOff(),
+		out.EOI.ToOnOff(),
+		out.DAV.ToOnOff())
+	fmt.Printf("REN: %s, SRQ: %s, IFC: %s\n", out.REN.ToOnOff(), out.SRQ.ToOnOff(), out.IFC.ToOnOff())
+	fmt.Printf("DATA: 0x%02x\n", out.DIO)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Sync the bus from another goroutine, as a running drive does, calling each
+before every sync. The returned function stops syncing.
+*/
+func keepSyncing(port *BusPort, each func(n int)) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if each != nil {
+				each(n)
+			}
+			port.Sync()
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func TestConnectorWait(t *testing.T) {
+	bus := &IEEEBus{}
+
+	host := &DummyConnector{}
+	host.Reset()
+	bus.Attach(host)
+
+	drive := &DummyConnector{}
+	drive.Reset()
+	port := bus.Connect(drive)
+
+	stop := keepSyncing(port, func(n int) {
+		if n == 100 {
+			drive.Update(func(out *IEEE488) { out.NDAC = TRUE })
+		}
+	})
+	defer stop()
+
+	lines, ok := host.Wait(time.Second, func(i IEEE488) bool {
+		return i.NDAC == TRUE
+	})
+	if !ok || lines.NDAC != TRUE {
+		t.Errorf("NDAC %s after waiting, want true", lines.NDAC)
+	}
+
+	if !host.WaitSyncs(10, time.Second) {
+		t.Error("bus was not synced while waiting")
+	}
+
+	// Nothing ever asserts DAV
+	start := time.Now()
+	lines, ok = host.Wait(10*time.Millisecond, func(i IEEE488) bool {
+		return i.DAV == TRUE
+	})
+	if ok {
+		t.Error("wait for DAV succeeded")
+	}
+	if lines.NDAC != TRUE {
+		t.Errorf("NDAC %s after timing out, want true", lines.NDAC)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("gave up after %s, before the timeout", elapsed)
+	}
+}
+
+// The lines from before an update are never used to decide a wait
+func TestConnectorWaitAfterUpdate(t *testing.T) {
+	host := &DummyConnector{}
+	host.Reset()
+
+	lines := MakeIEEE488()
+	lines.NDAC = TRUE
+	ndac := func(i IEEE488) bool {
+		return i.NDAC == TRUE
+	}
+
+	// A sync before the update
+	host.Read()
+	host.Write(lines)
+	host.Update(func(out *IEEE488) { out.ATN = TRUE })
+	if _, ok := host.Wait(10*time.Millisecond, ndac); ok {
+		t.Error("wait succeeded without a sync after the update")
+	}
+
+	// A sync that read the outputs before the update, & delivered the lines after it
+	host.Read()
+	host.Update(func(out *IEEE488) { out.DAV = TRUE })
+	host.Write(lines)
+	if _, ok := host.Wait(10*time.Millisecond, ndac); ok {
+		t.Error("wait succeeded with lines worked out from the outputs before the update")
+	}
+
+	host.Read()
+	host.Write(lines)
+	if _, ok := host.Wait(10*time.Millisecond, ndac); !ok {
+		t.Error("wait failed after a sync")
+	}
+}
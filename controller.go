@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	CONTROLLER_TIMEOUT  = 500 * time.Millisecond // Default time to wait for devices to respond
+	CONTROLLER_MAX_READ = 64 * 1024              // Default number of bytes read before giving up on EOI
+)
+
+// The highest address each kind of command can carry
+const (
+	MAX_PRIMARY   = 30 // Listen or talk to 31 is unlisten or untalk
+	MAX_SECONDARY = 31
+	MAX_CHANNEL   = 15 // Open & close only have room for 16 channels
+)
+
+// Command bytes, sent while ATN is asserted
+const (
+	CMD_LISTEN   Byte = 0x20
+	CMD_UNLISTEN Byte = 0x3f
+	CMD_TALK     Byte = 0x40
+	CMD_UNTALK   Byte = 0x5f
+	CMD_SECOND   Byte = 0x60
+	CMD_CLOSE    Byte = 0xe0
+	CMD_OPEN     Byte = 0xf0
+)
+
+var (
+	ErrTimeout          = errors.New("timed out")
+	ErrDeviceNotPresent = errors.New("device not present")
+	ErrNoEOI            = errors.New("no EOI from the talker") // ReadUntilEOI read MaxRead bytes without one
+)
+
+// AddressError is returned when an address doesn't fit in a command
+type AddressError struct {
+	Command string
+	Address int
+	Max     int
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("%s: address %d is not between 0 and %d", e.Command, e.Address, e.Max)
+}
+
+// HandshakeError is returned when a device doesn't take part in a handshake
+type HandshakeError struct {
+	Op    string  // What the controller was waiting for
+	Lines IEEE488 // State of the bus when it gave up
+	Err   error   // ErrTimeout or ErrDeviceNotPresent
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %s (ATN=%s, DAV=%s, NRFD=%s, NDAC=%s)", e.Op, e.Err,
+		e.Lines.ATN.ToOnOff(), e.Lines.DAV.ToOnOff(), e.Lines.NRFD.ToOnOff(), e.Lines.NDAC.ToOnOff())
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+/*
+Controller is the host side of the bus: it addresses devices & sends or
+receives data through a connector, in the way a PET does.
+
+Commands are sent with ATN asserted, & ATN is held until data is sent or
+read, so that e.g. Talk & Second are one command sequence. Unlisten & Untalk
+finish the sequence, as does ReleaseATN.
+*/
+type Controller struct {
+	Timeout time.Duration // Time to wait for devices at each step of a handshake
+	MaxRead int           // Bytes ReadUntilEOI reads before giving up
+
+	connector *DummyConnector
+	atn       bool // ATN is asserted
+	talker    bool // A device has been told to talk
+}
+
+func NewController(connector *DummyConnector) *Controller {
+	return &Controller{
+		Timeout:   CONTROLLER_TIMEOUT,
+		MaxRead:   CONTROLLER_MAX_READ,
+		connector: connector,
+	}
+}
+
+// Listen tells a device to listen
+func (c *Controller) Listen(device int) error {
+	if device < 0 || device > MAX_PRIMARY {
+		return &AddressError{"listen", device, MAX_PRIMARY}
+	}
+	c.talker = false
+	return c.command(CMD_LISTEN | Byte(device))
+}
+
+// Talk tells a device to talk
+func (c *Controller) Talk(device int) error {
+	if device < 0 || device > MAX_PRIMARY {
+		return &AddressError{"talk", device, MAX_PRIMARY}
+	}
+	c.talker = true
+	return c.command(CMD_TALK | Byte(device))
+}
+
+// Second sends a secondary address to the device that was addressed
+func (c *Controller) Second(address int) error {
+	if address < 0 || address > MAX_SECONDARY {
+		return &AddressError{"second", address, MAX_SECONDARY}
+	}
+	return c.command(CMD_SECOND | Byte(address))
+}
+
+// Open a channel of the listener. The filename follows with SendBytes.
+func (c *Controller) Open(channel int) error {
+	if channel < 0 || channel > MAX_CHANNEL {
+		return &AddressError{"open", channel, MAX_CHANNEL}
+	}
+	return c.command(CMD_OPEN | Byte(channel))
+}
+
+// Close a channel of the listener
+func (c *Controller) Close(channel int) error {
+	if channel < 0 || channel > MAX_CHANNEL {
+		return &AddressError{"close", channel, MAX_CHANNEL}
+	}
+	return c.command(CMD_CLOSE | Byte(channel))
+}
+
+// Unlisten tells all listeners to stop listening, & finishes the command sequence
+func (c *Controller) Unlisten() error {
+	defer c.ReleaseATN()
+	return c.command(CMD_UNLISTEN)
+}
+
+// Untalk tells the talker to stop talking, & finishes the command sequence
+func (c *Controller) Untalk() error {
+	c.talker = false
+	defer c.ReleaseATN()
+	return c.command(CMD_UNTALK)
+}
+
+// Send a command byte, asserting ATN first if it isn't already
+func (c *Controller) command(b Byte) error {
+	if !c.atn {
+		// Only the controller talks while ATN is asserted
+		c.connector.Update(func(out *IEEE488) {
+			release(out)
+			out.ATN = TRUE
+		})
+		c.atn = true
+
+		// Devices acknowledge ATN by asserting NDAC
+		_, err := c.wait("acknowledge ATN", func(i IEEE488) bool {
+			return i.NDAC == TRUE
+		})
+		if err != nil {
+			return c.notPresent(err)
+		}
+	}
+
+	err := c.send(b, false)
+	if err != nil {
+		c.Abort()
+	}
+	return err
+}
+
+/*
+ReleaseATN finishes a command sequence. If a device was told to talk the
+controller becomes a listener, holding off the talker until it reads.
+*/
+func (c *Controller) ReleaseATN() {
+	if !c.atn {
+		return
+	}
+
+	talker := c.talker
+	c.connector.Update(func(out *IEEE488) {
+		if talker {
+			out.NDAC = TRUE
+			out.NRFD = TRUE
+		}
+		out.ATN = FALSE
+	})
+	c.atn = false
+}
+
+// SendBytes sends data to the listeners, with EOI on the last byte if eoi is set
+func (c *Controller) SendBytes(data []Byte, eoi bool) error {
+	if c.atn {
+		c.ReleaseATN()
+
+		/*
+			Listeners hold NRFD & NDAC as they see ATN released. Give them a chance
+			to, so that the first byte isn't taken as another command.
+		*/
+		if !c.connector.WaitSyncs(2, c.Timeout) {
+			c.Abort()
+			return &HandshakeError{"bus to sync", c.connector.In(), ErrTimeout}
+		}
+	}
+
+	for n, b := range data {
+		err := c.send(b, eoi && n == len(data)-1)
+		if err != nil {
+			c.Abort()
+			return err
+		}
+	}
+	return nil
+}
+
+// Handshake a byte to the listeners
+func (c *Controller) send(b Byte, eoi bool) error {
+	// If nobody is holding NRFD or NDAC, there is nobody listening
+	if lines := c.connector.In(); lines.NRFD != TRUE && lines.NDAC != TRUE {
+		return &HandshakeError{"send", lines, ErrDeviceNotPresent}
+	}
+
+	c.connector.Update(func(out *IEEE488) {
+		out.DIO = b
+		out.EOI = IEEEBoolFromBool(eoi)
+	})
+
+	_, err := c.wait("listeners ready for data", func(i IEEE488) bool {
+		return i.NRFD != TRUE
+	})
+	if err != nil {
+		return err
+	}
+	c.connector.Update(func(out *IEEE488) {
+		out.DAV = TRUE
+	})
+
+	_, err = c.wait("listeners accept data", func(i IEEE488) bool {
+		return i.NDAC != TRUE
+	})
+	if err != nil {
+		return err
+	}
+
+	c.connector.Update(func(out *IEEE488) {
+		out.DAV = FALSE
+		out.EOI = FALSE
+		out.DIO = 0
+	})
+
+	/*
+		The listeners hold NRFD from accepting the byte until they see DAV released.
+		NDAC isn't waited for, as a listener may go idle after the last byte.
+	*/
+	_, err = c.wait("listeners finish with data", func(i IEEE488) bool {
+		return i.NRFD != TRUE
+	})
+	return err
+}
+
+/*
+ReadUntilEOI reads from the talker until it sends a byte with EOI, or gives
+up with ErrNoEOI after MaxRead bytes. The bytes read so far are returned along
+with any error.
+*/
+func (c *Controller) ReadUntilEOI() ([]Byte, error) {
+	var data []Byte
+
+	c.ReleaseATN()
+
+	for {
+		b, eoi, err := c.read()
+		if err != nil {
+			c.Abort()
+			return data, err
+		}
+		data = append(data, b)
+		if eoi {
+			return data, nil
+		}
+		if len(data) >= c.MaxRead {
+			c.Abort()
+			return data, ErrNoEOI
+		}
+	}
+}
+
+// Handshake a byte from the talker
+func (c *Controller) read() (Byte, bool, error) {
+	// Ready for data
+	c.connector.Update(func(out *IEEE488) {
+		out.NDAC = TRUE
+		out.NRFD = FALSE
+	})
+
+	in, err := c.wait("talker to send data", func(i IEEE488) bool {
+		return i.DAV == TRUE
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	b, eoi := in.DIO, in.EOI == TRUE
+
+	// Accept the byte & wait for the talker to finish with it
+	c.connector.Update(func(out *IEEE488) {
+		out.NRFD = TRUE
+		out.NDAC = FALSE
+	})
+	_, err = c.wait("talker to release data", func(i IEEE488) bool {
+		return i.DAV != TRUE
+	})
+	c.connector.Update(func(out *IEEE488) {
+		out.NDAC = TRUE
+	})
+
+	return b, eoi, err
+}
+
+/*
+InterfaceClear pulses IFC to reset every device on the bus. IFC is held until
+the bus has been synced with it asserted, so that the drives have seen it.
+*/
+func (c *Controller) InterfaceClear() error {
+	c.connector.Update(func(out *IEEE488) {
+		out.IFC = TRUE
+	})
+	_, err := c.wait("devices to see IFC", func(i IEEE488) bool {
+		return i.IFC == TRUE
+	})
+	if err == nil && !c.connector.WaitSyncs(1, c.Timeout) {
+		err = &HandshakeError{"devices to see IFC", c.connector.In(), ErrTimeout}
+	}
+
+	c.connector.Update(func(out *IEEE488) {
+		out.IFC = FALSE
+	})
+	c.Abort()
+
+	return err
+}
+
+/*
+Abort releases the handshake, data & ATN lines & forgets any command
+sequence, e.g. after a device stops responding part way through one. It's
+called on every error, so the bus is never left held by the controller.
+*/
+func (c *Controller) Abort() {
+	c.connector.Update(release)
+	c.atn = false
+	c.talker = false
+}
+
+// Release the handshake, data & ATN lines
+func release(out *IEEE488) {
+	out.ATN = FALSE
+	out.DAV = FALSE
+	out.EOI = FALSE
+	out.NRFD = FALSE
+	out.NDAC = FALSE
+	out.DIO = 0
+}
+
+// RemoteEnable sets or clears REN
+func (c *Controller) RemoteEnable(on bool) {
+	c.connector.Update(func(out *IEEE488) {
+		out.REN = IEEEBoolFromBool(on)
+	})
+}
+
+// Wait for a condition on the bus, giving up after the timeout
+func (c *Controller) wait(op string, ok func(IEEE488) bool) (IEEE488, error) {
+	lines, done := c.connector.Wait(c.Timeout, ok)
+	if !done {
+		return lines, &HandshakeError{op, lines, ErrTimeout}
+	}
+	return lines, nil
+}
+
+// Report a device that didn't respond to ATN as not present
+func (c *Controller) notPresent(err error) error {
+	var h *HandshakeError
+	if errors.As(err, &h) {
+		h.Err = ErrDeviceNotPresent
+	}
+	c.Abort()
+	return err
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Address of the CLI at the end of the drive's initialisation
+const BOOTED = 0xec3d
+
+// Boot drives on a bus with a controller, & leave them running
+func newControlledBus(t *testing.T, devices ...int) (*Controller, []*CBM2031) {
+	bus := &IEEEBus{}
+	host := &DummyConnector{}
+	host.Reset()
+	bus.Attach(host)
+
+	drives := make([]*CBM2031, len(devices))
+	for n, device := range devices {
+		// Drives run at real speed, so that they leave time for the controller
+		c := mustNewCBM2031(device)
+		c.Connect(bus)
+		drives[n] = c
+	}
+
+	for _, c := range drives {
+		err := c.RunUntil(context.Background(), BOOTED)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, len(drives))
+	t.Cleanup(func() {
+		cancel()
+		for range drives {
+			<-done
+		}
+	})
+	for _, c := range drives {
+		c := c
+		go func() {
+			done <- c.Run(ctx)
+		}()
+	}
+
+	controller := NewController(host)
+	controller.Timeout = 5 * time.Second
+
+	return controller, drives
+}
+
+// Boot a drive on a bus with a controller, & leave it running
+func newControlledDrive(t *testing.T) *Controller {
+	c, _ := newControlledBus(t, DEFAULT_DEVICE)
+	return c
+}
+
+/*
+Give a drive time to act on a command. The DOS runs commands from its idle
+loop once the bus is released.
+*/
+func settle(t *testing.T, c *CBM2031) {
+	t.Helper()
+
+	end := c.Instructions() + 10000
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Instructions() < end {
+		if time.Now().After(deadline) {
+			t.Fatal("drive isn't running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Send a command to a device's command channel
+func sendCommand(t *testing.T, c *Controller, device int, command string) {
+	t.Helper()
+
+	err := c.Listen(device)
+	if err == nil {
+		err = c.Second(15)
+	}
+	if err == nil {
+		err = c.SendBytes([]Byte(command), true)
+	}
+	if err == nil {
+		err = c.Unlisten()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read a channel of a device until EOI
+func readChannel(t *testing.T, c *Controller, device, channel int) string {
+	t.Helper()
+
+	err := c.Talk(device)
+	if err == nil {
+		err = c.Second(channel)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.ReadUntilEOI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Untalk(); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestControllerErrorChannel(t *testing.T) {
+	c := newControlledDrive(t)
+
+	if got, want := readChannel(t, c, DEFAULT_DEVICE, 15), "73,CBM DOS V2.6 2031,00,00\r"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestControllerSend(t *testing.T) {
+	c, drives := newControlledBus(t, DEFAULT_DEVICE)
+
+	// Write 3 bytes at $0500
+	sendCommand(t, c, DEFAULT_DEVICE, "M-W\x00\x05\x03\x12\x34\x56")
+	settle(t, drives[0])
+	if got, want := readChannel(t, c, DEFAULT_DEVICE, 15), "00, OK,00,00\r"; got != want {
+		t.Errorf("status %q after M-W, want %q", got, want)
+	}
+
+	// Read them back
+	sendCommand(t, c, DEFAULT_DEVICE, "M-R\x00\x05\x03")
+	settle(t, drives[0])
+	if got, want := readChannel(t, c, DEFAULT_DEVICE, 15), "\x12\x34\x56\r"; got != want {
+		t.Errorf("M-R read %q, want %q", got, want)
+	}
+}
+
+func TestControllerDeviceNotPresent(t *testing.T) {
+	host := &DummyConnector{}
+	host.Reset()
+	host.Write(MakeIEEE488()) // Nothing on the bus pulls any lines
+
+	c := NewController(host)
+	c.Timeout = 10 * time.Millisecond
+
+	err := c.Listen(DEFAULT_DEVICE)
+	if !errors.Is(err, ErrDeviceNotPresent) {
+		t.Errorf("got %v, want %v", err, ErrDeviceNotPresent)
+	}
+	var h *HandshakeError
+	if !errors.As(err, &h) {
+		t.Errorf("got %T, want a *HandshakeError", err)
+	}
+	if host.Out().ATN != FALSE {
+		t.Error("ATN left asserted")
+	}
+}
+
+// A listener that stops responding part way through leaves the bus released
+func TestControllerAbort(t *testing.T) {
+	bus := &IEEEBus{}
+	host := &DummyConnector{}
+	host.Reset()
+	bus.Attach(host)
+
+	listener := &DummyConnector{}
+	listener.Reset()
+	listener.Update(func(out *IEEE488) {
+		out.NDAC = TRUE
+		out.NRFD = TRUE // Never ready for data
+	})
+	stop := keepSyncing(bus.Connect(listener), nil)
+	defer stop()
+
+	c := NewController(host)
+	c.Timeout = 10 * time.Millisecond
+
+	err := c.Listen(DEFAULT_DEVICE)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+	out := host.Out()
+	for _, line := range []IEEEBool{out.ATN, out.DAV, out.EOI, out.NRFD, out.NDAC} {
+		if line != FALSE {
+			t.Fatalf("lines left held: %+v", out)
+		}
+	}
+	if out.DIO != 0 {
+		t.Errorf("DIO left as $%02x", out.DIO)
+	}
+	if c.atn || c.talker {
+		t.Error("command sequence not forgotten")
+	}
+}
+
+func TestControllerAddressRange(t *testing.T) {
+	host := &DummyConnector{}
+	host.Reset()
+	c := NewController(host)
+
+	for _, tt := range []struct {
+		command string
+		send    func(int) error
+		bad     []int
+	}{
+		{"listen", c.Listen, []int{-1, 31, 32}},
+		{"talk", c.Talk, []int{-1, 31}},
+		{"second", c.Second, []int{-1, 32}},
+		{"open", c.Open, []int{-1, 16}},
+		{"close", c.Close, []int{-1, 16}},
+	} {
+		for _, address := range tt.bad {
+			var a *AddressError
+			if err := tt.send(address); !errors.As(err, &a) {
+				t.Errorf("%s %d: got %v, want an *AddressError", tt.command, address, err)
+			}
+		}
+	}
+	if out := host.Out(); out.ATN == TRUE || out.DAV == TRUE {
+		t.Error("a command was sent for an address out of range")
+	}
+}
+
+// Reading gives up if the talker never sends EOI
+func TestControllerMaxRead(t *testing.T) {
+	c := newControlledDrive(t)
+	c.MaxRead = 5
+
+	err := c.Talk(DEFAULT_DEVICE)
+	if err == nil {
+		err = c.Second(15)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.ReadUntilEOI()
+	if err != ErrNoEOI {
+		t.Errorf("got %v, want %v", err, ErrNoEOI)
+	}
+	if string(data) != "73,CB" {
+		t.Errorf("read %q, want the first 5 bytes", data)
+	}
+	if out := c.connector.Out(); out.NDAC == TRUE || out.NRFD == TRUE {
+		t.Error("handshake lines left held")
+	}
+}
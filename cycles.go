@@ -0,0 +1,104 @@
+package main
+
+import "github.com/vanders/pet/mos6502"
+
+/*
+Number of cycles taken by each opcode on an NMOS 6502, not including extra
+cycles for taken branches or indexing across a page boundary. Undocumented
+opcodes are included for completeness.
+*/
+var opcodeCycles = [256]int{
+	//   0  1  2  3  4  5  6  7  8  9  a  b  c  d  e  f
+	7, 6, 2, 8, 3, 3, 5, 5, 3, 2, 2, 2, 4, 4, 6, 6, // 0x00
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7, // 0x10
+	6, 6, 2, 8, 3, 3, 5, 5, 4, 2, 2, 2, 4, 4, 6, 6, // 0x20
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7, // 0x30
+	6, 6, 2, 8, 3, 3, 5, 5, 3, 2, 2, 2, 3, 4, 6, 6, // 0x40
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7, // 0x50
+	6, 6, 2, 8, 3, 3, 5, 5, 4, 2, 2, 2, 5, 4, 6, 6, // 0x60
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7, // 0x70
+	2, 6, 2, 6, 3, 3, 3, 3, 2, 2, 2, 2, 4, 4, 4, 4, // 0x80
+	2, 6, 2, 6, 4, 4, 4, 4, 2, 5, 2, 5, 5, 5, 5, 5, // 0x90
+	2, 6, 2, 6, 3, 3, 3, 3, 2, 2, 2, 2, 4, 4, 4, 4, // 0xa0
+	2, 5, 2, 5, 4, 4, 4, 4, 2, 4, 2, 4, 4, 4, 4, 4, // 0xb0
+	2, 6, 2, 8, 3, 3, 5, 5, 2, 2, 2, 2, 4, 4, 6, 6, // 0xc0
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7, // 0xd0
+	2, 6, 2, 8, 3, 3, 5, 5, 2, 2, 2, 2, 4, 4, 6, 6, // 0xe0
+	2, 5, 2, 8, 4, 4, 6, 6, 2, 4, 2, 7, 4, 4, 7, 7, // 0xf0
+}
+
+// Cycles taken to service an interrupt
+const INTERRUPT_CYCLES = 7
+
+// Opcodes that call & return from subroutines & interrupt handlers
+const (
+	OPCODE_JSR = 0x20
+	OPCODE_RTI = 0x40
+	OPCODE_RTS = 0x60
+)
+
+// JAM opcodes halt the CPU until it is reset
+func isJAM(opcode Byte) bool {
+	return opcode&0x0f == 0x02 && opcode&0x90 != 0x80
+}
+
+// Indexed addressing modes where crossing a page costs an extra cycle
+const (
+	INDEX_NONE = iota
+	INDEX_ABSOLUTE_X
+	INDEX_ABSOLUTE_Y
+	INDEX_INDIRECT_Y
+)
+
+/*
+Read instructions take an extra cycle when the index carries into the high
+byte of the address. Stores & read-modify-write instructions always take the
+extra cycle, so it is included in their base count.
+*/
+func pageCrossIndex(opcode Byte) int {
+	switch opcode {
+	case 0x1d, 0x3d, 0x5d, 0x7d, 0xbc, 0xbd, 0xdd, 0xfd:
+		return INDEX_ABSOLUTE_X
+	case 0x19, 0x39, 0x59, 0x79, 0xb9, 0xbe, 0xd9, 0xf9:
+		return INDEX_ABSOLUTE_Y
+	case 0x11, 0x31, 0x51, 0x71, 0xb1, 0xd1, 0xf1:
+		return INDEX_INDIRECT_Y
+	}
+	return INDEX_NONE
+}
+
+func isBranch(opcode Byte) bool {
+	return opcode&0x1f == 0x10
+}
+
+/*
+Whether a branch is taken, from the flags before it executes. Bits 7 & 6 of
+the opcode select the flag (N, V, C or Z) & bit 5 is the value to branch on.
+*/
+func branchTaken(opcode Byte, p mos6502.Flags) bool {
+	var flag bool
+	switch opcode >> 6 {
+	case 0:
+		flag = p.N
+	case 1:
+		flag = p.V
+	case 2:
+		flag = p.C
+	case 3:
+		flag = p.Z
+	}
+	return flag == (opcode&0x20 != 0)
+}
+
+/*
+A taken branch takes an extra cycle, and another if the destination is on a
+different page to the following instruction
+*/
+func branchCycles(pc Word, offset Byte) int {
+	fallthru := pc + 2
+	next := fallthru + Word(int8(offset))
+	if next&0xff00 != fallthru&0xff00 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestInstructionCycles(t *testing.T) {
+	// Close enough to the end of a page for a branch to cross it
+	const origin = 0x3f0
+
+	tests := []struct {
+		name    string
+		program []Byte
+		x, y    Byte
+		want    int
+	}{
+		{"NOP", []Byte{0xea}, 0, 0, 2},
+		{"LDA immediate", []Byte{0xa9, 0x01}, 0, 0, 2},
+		{"LDA absolute,X", []Byte{0xbd, 0x10, 0x02}, 0x01, 0, 4},
+		{"LDA absolute,X across a page", []Byte{0xbd, 0xff, 0x02}, 0x01, 0, 5},
+		{"LDA absolute,Y across a page", []Byte{0xb9, 0xff, 0x02}, 0, 0x01, 5},
+		{"STA absolute,X across a page", []Byte{0x9d, 0xff, 0x02}, 0x01, 0, 5},
+		{"STA absolute,X", []Byte{0x9d, 0x10, 0x02}, 0x01, 0, 5},
+		{"LDA (zp),Y", []Byte{0xb1, 0x80}, 0, 0x01, 5},
+		{"LDA (zp),Y across a page", []Byte{0xb1, 0x82}, 0, 0x01, 6},
+		{"JSR", []Byte{0x20, 0x00, 0x04}, 0, 0, 6},
+		{"BNE not taken", []Byte{0xa9, 0x00, 0xd0, 0x02}, 0, 0, 2 + 2},
+		{"BNE taken", []Byte{0xa9, 0x01, 0xd0, 0x02}, 0, 0, 2 + 3},
+		{"BNE taken across a page", []Byte{0xa9, 0x01, 0xd0, 0x10}, 0, 0, 2 + 4},
+		{"BNE taken to the next instruction", []Byte{0xa9, 0x01, 0xd0, 0x00}, 0, 0, 2 + 3},
+		{"BEQ not taken", []Byte{0xa9, 0x01, 0xf0, 0x00}, 0, 0, 2 + 2},
+		{"BMI taken", []Byte{0xa9, 0x80, 0x30, 0x00}, 0, 0, 2 + 3},
+		{"BCS not taken", []Byte{0x18, 0xb0, 0x00}, 0, 0, 2 + 2},
+		{"BCC taken", []Byte{0x18, 0x90, 0x00}, 0, 0, 2 + 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mustNewCBM2031(DEFAULT_DEVICE)
+
+			// Pointers for the indirect tests: $0210 & $02ff
+			c.ram.Write(0x80, 0x10)
+			c.ram.Write(0x81, 0x02)
+			c.ram.Write(0x82, 0xff)
+			c.ram.Write(0x83, 0x02)
+
+			for n, b := range tt.program {
+				c.ram.Write(origin+Word(n), b)
+			}
+			c.cpu.PC.Set(origin)
+			c.cpu.Registers.X.Set(tt.x)
+			c.cpu.Registers.Y.Set(tt.y)
+
+			var cycles int
+			for c.cpu.PC.Get() < origin+Word(len(tt.program)) {
+				n, err := c.step()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cycles += n
+
+				// Stop after a taken branch
+				if c.cpu.PC.Get() > origin+Word(len(tt.program)) || c.cpu.PC.Get() < origin {
+					break
+				}
+			}
+
+			if cycles != tt.want {
+				t.Errorf("took %d cycles, want %d", cycles, tt.want)
+			}
+		})
+	}
+}
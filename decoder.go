@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Transfer is a byte sent with the DAV/NRFD/NDAC handshake
+type Transfer struct {
+	Cycle  uint64 // DAV was asserted
+	Cycles uint64 // From DAV being asserted to NDAC being released
+	Data   Byte
+	ATN    bool // Sent while ATN was asserted, so it is a command
+	EOI    bool
+}
+
+/*
+DecodeTransfers finds the bytes handshaked across the bus. A byte starts when
+DAV is asserted & is complete when the listeners release NDAC to accept it.
+A byte that is abandoned before it is accepted is still returned, with its
+length measured to when DAV was released.
+*/
+func DecodeTransfers(samples []Sample) []Transfer {
+	var (
+		transfers []Transfer
+		current   *Transfer
+	)
+
+	for n, s := range samples {
+		dav := s.Lines.DAV == TRUE
+
+		if current == nil {
+			if dav && (n == 0 || samples[n-1].Lines.DAV != TRUE) {
+				current = &Transfer{
+					Cycle: s.Cycle,
+					Data:  s.Lines.DIO,
+					ATN:   s.Lines.ATN == TRUE,
+					EOI:   s.Lines.EOI == TRUE,
+				}
+			}
+			continue
+		}
+
+		if s.Lines.NDAC != TRUE || !dav {
+			current.Cycles = s.Cycle - current.Cycle
+			transfers = append(transfers, *current)
+			current = nil
+		}
+	}
+	return transfers
+}
+
+// Kinds of event on the bus
+const (
+	EVENT_LISTEN   = "LISTEN"
+	EVENT_UNLISTEN = "UNLISTEN"
+	EVENT_TALK     = "TALK"
+	EVENT_UNTALK   = "UNTALK"
+	EVENT_SECOND   = "SECOND"
+	EVENT_CLOSE    = "CLOSE"
+	EVENT_OPEN     = "OPEN"
+	EVENT_COMMAND  = "COMMAND" // Any other command byte
+	EVENT_DATA     = "DATA"
+)
+
+// Event is a command or data byte on the bus
+type Event struct {
+	Cycle   uint64 `json:"cycle"`
+	Cycles  uint64 `json:"cycles"` // Length of the handshake
+	Type    string `json:"type"`
+	Address *int   `json:"address,omitempty"` // Primary or secondary address, for commands that have one
+	Data    Byte   `json:"data"`
+	EOI     bool   `json:"eoi,omitempty"`
+}
+
+// Decode turns the samples from an analyzer into commands & data
+func Decode(samples []Sample) []Event {
+	transfers := DecodeTransfers(samples)
+	events := make([]Event, len(transfers))
+
+	for n, t := range transfers {
+		e := Event{
+			Cycle:  t.Cycle,
+			Cycles: t.Cycles,
+			Type:   EVENT_DATA,
+			Data:   t.Data,
+			EOI:    t.EOI,
+		}
+		if t.ATN {
+			e.Type, e.Address = command(t.Data)
+		}
+		events[n] = e
+	}
+	return events
+}
+
+// Decode a command byte sent under ATN, with its address if it has one
+func command(b Byte) (string, *int) {
+	address := func(mask Byte) *int {
+		a := int(b & mask)
+		return &a
+	}
+
+	switch {
+	case b == 0x3f:
+		return EVENT_UNLISTEN, nil
+	case b == 0x5f:
+		return EVENT_UNTALK, nil
+	case b >= 0x20 && b < 0x3f:
+		return EVENT_LISTEN, address(0x1f)
+	case b >= 0x40 && b < 0x5f:
+		return EVENT_TALK, address(0x1f)
+	case b >= 0x60 && b < 0x80:
+		return EVENT_SECOND, address(0x1f)
+	case b >= 0xe0 && b < 0xf0:
+		return EVENT_CLOSE, address(0x0f)
+	case b >= 0xf0:
+		return EVENT_OPEN, address(0x0f)
+	}
+	return EVENT_COMMAND, nil
+}
+
+func (e Event) String() string {
+	var s string
+
+	switch e.Type {
+	case EVENT_UNLISTEN, EVENT_UNTALK:
+		s = e.Type
+	case EVENT_LISTEN, EVENT_TALK, EVENT_SECOND, EVENT_CLOSE, EVENT_OPEN:
+		s = e.Type
+		if e.Address != nil {
+			s += fmt.Sprintf(" %d", *e.Address)
+		}
+	case EVENT_DATA:
+		ch := "."
+		if e.Data >= 0x20 && e.Data < 0x7f {
+			ch = string(rune(e.Data))
+		}
+		s = fmt.Sprintf("DATA $%02x %s", e.Data, ch)
+		if e.EOI {
+			s += " EOI"
+		}
+	default:
+		s = fmt.Sprintf("%s $%02x", e.Type, e.Data)
+	}
+	return fmt.Sprintf("%10d  %-16s (%d cycles)", e.Cycle, s, e.Cycles)
+}
+
+// WriteEventsText writes the events as text, one event per line
+func WriteEventsText(w io.Writer, events []Event) error {
+	for _, e := range events {
+		_, err := fmt.Fprintln(w, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteEventsJSON writes the events as JSON lines, one event per line
+func WriteEventsJSON(w io.Writer, events []Event) error {
+	e := json.NewEncoder(w)
+	for _, event := range events {
+		err := e.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteEventsFile writes JSON lines if the filename ends in .json or .jsonl, else text
+func WriteEventsFile(filename string, events []Event) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(filename, ".json") || strings.HasSuffix(filename, ".jsonl") {
+		err = WriteEventsJSON(f, events)
+	} else {
+		err = WriteEventsText(f, events)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
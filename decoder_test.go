@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The address of a command event
+func address(a int) *int {
+	return &a
+}
+
+// Build the samples for a byte handshaked across the bus, starting at cycle
+func handshake(cycle uint64, data Byte, atn, eoi bool) []Sample {
+	idle := MakeIEEE488()
+	idle.ATN = IEEEBoolFromBool(atn)
+	idle.NDAC = TRUE
+
+	valid := idle
+	valid.DIO = data
+	valid.EOI = IEEEBoolFromBool(eoi)
+	valid.DAV = TRUE
+	valid.NRFD = FALSE
+
+	busy := valid
+	busy.NRFD = TRUE
+
+	accepted := busy
+	accepted.NDAC = FALSE
+
+	return []Sample{
+		{cycle, idle},
+		{cycle + 10, valid},
+		{cycle + 12, busy},
+		{cycle + 30, accepted},
+		{cycle + 40, idle},
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var samples []Sample
+	for n, b := range []struct {
+		data     Byte
+		atn, eoi bool
+	}{
+		{0x28, true, false},
+		{0xf2, true, false},
+		{0x7f, true, false},
+		{'A', false, false},
+		{'B', false, true},
+		{0x3f, true, false},
+	} {
+		samples = append(samples, handshake(uint64(n)*100, b.data, b.atn, b.eoi)...)
+	}
+
+	events := Decode(samples)
+	want := []Event{
+		{Cycle: 10, Cycles: 20, Type: EVENT_LISTEN, Address: address(8), Data: 0x28},
+		{Cycle: 110, Cycles: 20, Type: EVENT_OPEN, Address: address(2), Data: 0xf2},
+		{Cycle: 210, Cycles: 20, Type: EVENT_SECOND, Address: address(31), Data: 0x7f},
+		{Cycle: 310, Cycles: 20, Type: EVENT_DATA, Data: 'A'},
+		{Cycle: 410, Cycles: 20, Type: EVENT_DATA, Data: 'B', EOI: true},
+		{Cycle: 510, Cycles: 20, Type: EVENT_UNLISTEN, Data: 0x3f},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("%d events, want %d: %v", len(events), len(want), events)
+	}
+	for n := range want {
+		if !reflect.DeepEqual(events[n], want[n]) {
+			t.Errorf("event %d is %+v, want %+v", n, events[n], want[n])
+		}
+	}
+
+	var text bytes.Buffer
+	err := WriteEventsText(&text, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"LISTEN 8 ", "SECOND 31 ", "DATA $42 B EOI"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text log is missing %q:\n%s", want, text.String())
+		}
+	}
+
+	var lines bytes.Buffer
+	err = WriteEventsJSON(&lines, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(lines.String(), "\n"); n != len(events) {
+		t.Errorf("%d JSON lines, want %d", n, len(events))
+	}
+
+	// Only commands with an address have one in the JSON
+	if n := strings.Count(lines.String(), `"address"`); n != 3 {
+		t.Errorf("%d JSON lines with an address, want 3:\n%s", n, lines.String())
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type addressMode int
+
+const (
+	IMPLIED addressMode = iota
+	ACCUMULATOR
+	IMMEDIATE
+	ZERO_PAGE
+	ZERO_PAGE_X
+	ZERO_PAGE_Y
+	ABSOLUTE
+	ABSOLUTE_X
+	ABSOLUTE_Y
+	INDIRECT
+	INDIRECT_X
+	INDIRECT_Y
+	RELATIVE
+)
+
+// Size of each addressing mode's instructions, including the opcode
+var modeSize = [...]int{
+	IMPLIED:     1,
+	ACCUMULATOR: 1,
+	IMMEDIATE:   2,
+	ZERO_PAGE:   2,
+	ZERO_PAGE_X: 2,
+	ZERO_PAGE_Y: 2,
+	ABSOLUTE:    3,
+	ABSOLUTE_X:  3,
+	ABSOLUTE_Y:  3,
+	INDIRECT:    3,
+	INDIRECT_X:  2,
+	INDIRECT_Y:  2,
+	RELATIVE:    2,
+}
+
+type instruction struct {
+	mnemonic string
+	mode     addressMode
+}
+
+// The documented 6502 instructions. Anything else is shown as a byte of data.
+var instructions = [256]instruction{
+	0x69: {"ADC", IMMEDIATE}, 0x65: {"ADC", ZERO_PAGE}, 0x75: {"ADC", ZERO_PAGE_X}, 0x6d: {"ADC", ABSOLUTE},
+	0x7d: {"ADC", ABSOLUTE_X}, 0x79: {"ADC", ABSOLUTE_Y}, 0x61: {"ADC", INDIRECT_X}, 0x71: {"ADC", INDIRECT_Y},
+	0x29: {"AND", IMMEDIATE}, 0x25: {"AND", ZERO_PAGE}, 0x35: {"AND", ZERO_PAGE_X}, 0x2d: {"AND", ABSOLUTE},
+	0x3d: {"AND", ABSOLUTE_X}, 0x39: {"AND", ABSOLUTE_Y}, 0x21: {"AND", INDIRECT_X}, 0x31: {"AND", INDIRECT_Y},
+	0x0a: {"ASL", ACCUMULATOR}, 0x06: {"ASL", ZERO_PAGE}, 0x16: {"ASL", ZERO_PAGE_X}, 0x0e: {"ASL", ABSOLUTE},
+	0x1e: {"ASL", ABSOLUTE_X},
+	0x90: {"BCC", RELATIVE}, 0xb0: {"BCS", RELATIVE}, 0xf0: {"BEQ", RELATIVE}, 0x30: {"BMI", RELATIVE},
+	0xd0: {"BNE", RELATIVE}, 0x10: {"BPL", RELATIVE}, 0x50: {"BVC", RELATIVE}, 0x70: {"BVS", RELATIVE},
+	0x24: {"BIT", ZERO_PAGE}, 0x2c: {"BIT", ABSOLUTE},
+	0x00: {"BRK", IMPLIED},
+	0x18: {"CLC", IMPLIED}, 0xd8: {"CLD", IMPLIED}, 0x58: {"CLI", IMPLIED}, 0xb8: {"CLV", IMPLIED},
+	0xc9: {"CMP", IMMEDIATE}, 0xc5: {"CMP", ZERO_PAGE}, 0xd5: {"CMP", ZERO_PAGE_X}, 0xcd: {"CMP", ABSOLUTE},
+	0xdd: {"CMP", ABSOLUTE_X}, 0xd9: {"CMP", ABSOLUTE_Y}, 0xc1: {"CMP", INDIRECT_X}, 0xd1: {"CMP", INDIRECT_Y},
+	0xe0: {"CPX", IMMEDIATE}, 0xe4: {"CPX", ZERO_PAGE}, 0xec: {"CPX", ABSOLUTE},
+	0xc0: {"CPY", IMMEDIATE}, 0xc4: {"CPY", ZERO_PAGE}, 0xcc: {"CPY", ABSOLUTE},
+	0xc6: {"DEC", ZERO_PAGE}, 0xd6: {"DEC", ZERO_PAGE_X}, 0xce: {"DEC", ABSOLUTE}, 0xde: {"DEC", ABSOLUTE_X},
+	0xca: {"DEX", IMPLIED}, 0x88: {"DEY", IMPLIED},
+	0x49: {"EOR", IMMEDIATE}, 0x45: {"EOR", ZERO_PAGE}, 0x55: {"EOR", ZERO_PAGE_X}, 0x4d: {"EOR", ABSOLUTE},
+	0x5d: {"EOR", ABSOLUTE_X}, 0x59: {"EOR", ABSOLUTE_Y}, 0x41: {"EOR", INDIRECT_X}, 0x51: {"EOR", INDIRECT_Y},
+	0xe6: {"INC", ZERO_PAGE}, 0xf6: {"INC", ZERO_PAGE_X}, 0xee: {"INC", ABSOLUTE}, 0xfe: {"INC", ABSOLUTE_X},
+	0xe8: {"INX", IMPLIED}, 0xc8: {"INY", IMPLIED},
+	0x4c: {"JMP", ABSOLUTE}, 0x6c: {"JMP", INDIRECT},
+	0x20: {"JSR", ABSOLUTE},
+	0xa9: {"LDA", IMMEDIATE}, 0xa5: {"LDA", ZERO_PAGE}, 0xb5: {"LDA", ZERO_PAGE_X}, 0xad: {"LDA", ABSOLUTE},
+	0xbd: {"LDA", ABSOLUTE_X}, 0xb9: {"LDA", ABSOLUTE_Y}, 0xa1: {"LDA", INDIRECT_X}, 0xb1: {"LDA", INDIRECT_Y},
+	0xa2: {"LDX", IMMEDIATE}, 0xa6: {"LDX", ZERO_PAGE}, 0xb6: {"LDX", ZERO_PAGE_Y}, 0xae: {"LDX", ABSOLUTE},
+	0xbe: {"LDX", ABSOLUTE_Y},
+	0xa0: {"LDY", IMMEDIATE}, 0xa4: {"LDY", ZERO_PAGE}, 0xb4: {"LDY", ZERO_PAGE_X}, 0xac: {"LDY", ABSOLUTE},
+	0xbc: {"LDY", ABSOLUTE_X},
+	0x4a: {"LSR", ACCUMULATOR}, 0x46: {"LSR", ZERO_PAGE}, 0x56: {"LSR", ZERO_PAGE_X}, 0x4e: {"LSR", ABSOLUTE},
+	0x5e: {"LSR", ABSOLUTE_X},
+	0xea: {"NOP", IMPLIED},
+	0x09: {"ORA", IMMEDIATE}, 0x05: {"ORA", ZERO_PAGE}, 0x15: {"ORA", ZERO_PAGE_X}, 0x0d: {"ORA", ABSOLUTE},
+	0x1d: {"ORA", ABSOLUTE_X}, 0x19: {"ORA", ABSOLUTE_Y}, 0x01: {"ORA", INDIRECT_X}, 0x11: {"ORA", INDIRECT_Y},
+	0x48: {"PHA", IMPLIED}, 0x08: {"PHP", IMPLIED}, 0x68: {"PLA", IMPLIED}, 0x28: {"PLP", IMPLIED},
+	0x2a: {"ROL", ACCUMULATOR}, 0x26: {"ROL", ZERO_PAGE}, 0x36: {"ROL", ZERO_PAGE_X}, 0x2e: {"ROL", ABSOLUTE},
+	0x3e: {"ROL", ABSOLUTE_X},
+	0x6a: {"ROR", ACCUMULATOR}, 0x66: {"ROR", ZERO_PAGE}, 0x76: {"ROR", ZERO_PAGE_X}, 0x6e: {"ROR", ABSOLUTE},
+	0x7e: {"ROR", ABSOLUTE_X},
+	0x40: {"RTI", IMPLIED}, 0x60: {"RTS", IMPLIED},
+	0xe9: {"SBC", IMMEDIATE}, 0xe5: {"SBC", ZERO_PAGE}, 0xf5: {"SBC", ZERO_PAGE_X}, 0xed: {"SBC", ABSOLUTE},
+	0xfd: {"SBC", ABSOLUTE_X}, 0xf9: {"SBC", ABSOLUTE_Y}, 0xe1: {"SBC", INDIRECT_X}, 0xf1: {"SBC", INDIRECT_Y},
+	0x38: {"SEC", IMPLIED}, 0xf8: {"SED", IMPLIED}, 0x78: {"SEI", IMPLIED},
+	0x85: {"STA", ZERO_PAGE}, 0x95: {"STA", ZERO_PAGE_X}, 0x8d: {"STA", ABSOLUTE}, 0x9d: {"STA", ABSOLUTE_X},
+	0x99: {"STA", ABSOLUTE_Y}, 0x81: {"STA", INDIRECT_X}, 0x91: {"STA", INDIRECT_Y},
+	0x86: {"STX", ZERO_PAGE}, 0x96: {"STX", ZERO_PAGE_Y}, 0x8e: {"STX", ABSOLUTE},
+	0x84: {"STY", ZERO_PAGE}, 0x94: {"STY", ZERO_PAGE_X}, 0x8c: {"STY", ABSOLUTE},
+	0xaa: {"TAX", IMPLIED}, 0xa8: {"TAY", IMPLIED}, 0xba: {"TSX", IMPLIED}, 0x8a: {"TXA", IMPLIED},
+	0x9a: {"TXS", IMPLIED}, 0x98: {"TYA", IMPLIED},
+}
+
+/*
+Disassemble the instruction at address, returning the text & the size of the
+instruction in bytes. Addresses are replaced with labels when symbols are
+given.
+*/
+func Disassemble(read func(Word) Byte, address Word, symbols *Symbols) (string, int) {
+	opcode := read(address)
+	ins := instructions[opcode]
+	if ins.mnemonic == "" {
+		return fmt.Sprintf("$%04x  %-8s  .byte $%02x", address, hexBytes([]Byte{opcode}), opcode), 1
+	}
+
+	size := modeSize[ins.mode]
+	bytes := make([]Byte, size)
+	for n := range bytes {
+		bytes[n] = read(address + Word(n))
+	}
+
+	var operand Word
+	switch size {
+	case 2:
+		operand = Word(bytes[1])
+	case 3:
+		operand = Word(bytes[2])<<8 | Word(bytes[1])
+	}
+
+	// Show labels for zero page & absolute addresses
+	name := func(format string, addr Word) string {
+		if label, ok := symbols.Name(addr); ok {
+			return label
+		}
+		return fmt.Sprintf(format, addr)
+	}
+
+	var arg string
+	switch ins.mode {
+	case ACCUMULATOR:
+		arg = "A"
+	case IMMEDIATE:
+		arg = fmt.Sprintf("#$%02x", operand)
+	case ZERO_PAGE:
+		arg = name("$%02x", operand)
+	case ZERO_PAGE_X:
+		arg = name("$%02x", operand) + ",X"
+	case ZERO_PAGE_Y:
+		arg = name("$%02x", operand) + ",Y"
+	case ABSOLUTE:
+		arg = name("$%04x", operand)
+	case ABSOLUTE_X:
+		arg = name("$%04x", operand) + ",X"
+	case ABSOLUTE_Y:
+		arg = name("$%04x", operand) + ",Y"
+	case INDIRECT:
+		arg = "(" + name("$%04x", operand) + ")"
+	case INDIRECT_X:
+		arg = "(" + name("$%02x", operand) + ",X)"
+	case INDIRECT_Y:
+		arg = "(" + name("$%02x", operand) + "),Y"
+	case RELATIVE:
+		target := address + 2 + Word(int8(operand))
+		arg = name("$%04x", target)
+	}
+
+	text := strings.TrimSpace(ins.mnemonic + " " + arg)
+	return fmt.Sprintf("$%04x  %-8s  %s", address, hexBytes(bytes), text), size
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	symbols := NewSymbols()
+	symbols.Add(0x0077, "listen")
+	symbols.Add(0xe853, "irq")
+
+	tests := []struct {
+		code []Byte
+		want string
+		size int
+	}{
+		{[]Byte{0xea}, "$1000  ea        NOP", 1},
+		{[]Byte{0x0a}, "$1000  0a        ASL A", 1},
+		{[]Byte{0xa9, 0x10}, "$1000  a9 10     LDA #$10", 2},
+		{[]Byte{0xa5, 0x77}, "$1000  a5 77     LDA listen", 2},
+		{[]Byte{0xb6, 0x10}, "$1000  b6 10     LDX $10,Y", 2},
+		{[]Byte{0x9d, 0x00, 0x02}, "$1000  9d 00 02  STA $0200,X", 3},
+		{[]Byte{0x6c, 0xfc, 0xff}, "$1000  6c fc ff  JMP ($fffc)", 3},
+		{[]Byte{0x81, 0x77}, "$1000  81 77     STA (listen,X)", 2},
+		{[]Byte{0xb1, 0x30}, "$1000  b1 30     LDA ($30),Y", 2},
+		{[]Byte{0x20, 0x53, 0xe8}, "$1000  20 53 e8  JSR irq", 3},
+		{[]Byte{0xd0, 0xfe}, "$1000  d0 fe     BNE $1000", 2},
+		{[]Byte{0x10, 0x10}, "$1000  10 10     BPL $1012", 2},
+		{[]Byte{0x02}, "$1000  02        .byte $02", 1},
+	}
+
+	for _, tt := range tests {
+		read := func(address Word) Byte {
+			return tt.code[address-0x1000]
+		}
+		got, size := Disassemble(read, 0x1000, symbols)
+		if got != tt.want || size != tt.size {
+			t.Errorf("got %q (%d bytes), want %q (%d bytes)", got, size, tt.want, tt.size)
+		}
+	}
+}
+
+func TestLoadSymbols(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dos.lbl")
+	err := os.WriteFile(filename, []byte("al C:e853 .irq\nal 0077 listen\n\nbreak e853\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadSymbols(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := s.Name(0xe853); !ok || name != "irq" {
+		t.Errorf("$e853 = %q, want irq", name)
+	}
+	if addr, ok := s.Address("listen"); !ok || addr != 0x77 {
+		t.Errorf("listen = $%04x, want $0077", addr)
+	}
+}
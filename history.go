@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	CHECKPOINT_INTERVAL = 100000 // Cycles between checkpoints
+	CHECKPOINT_COUNT    = 100    // Number of checkpoints kept
+)
+
+// ErrNoHistory is returned when rewinding further back than the history goes
+var ErrNoHistory = errors.New("not enough history recorded")
+
+/*
+History allows execution to be reversed. Snapshots of the drive are taken
+periodically, and the lines on the IEEE488 bus are recorded whenever they
+change. To go back, the nearest earlier checkpoint is restored & execution
+is repeated from there with the recorded bus inputs, which reproduces exactly
+what the drive did the first time around.
+
+Once re-execution catches up with the point where the history was rewound
+from, the drive goes back to using the live bus.
+*/
+type History struct {
+	checkpoints []checkpoint
+	inputs      []input
+	last        IEEE488 // Most recently recorded bus state
+	replayed    IEEE488 // Bus state at the point being re-executed
+	recorded    bool    // Anything has been recorded yet
+	end         uint64  // Instruction count that has been recorded up to
+	next        int     // Index of the next input to replay
+}
+
+type checkpoint struct {
+	instructions uint64
+	snapshot     *Snapshot
+	calls        []Byte // Shadow call stack
+}
+
+type input struct {
+	instructions uint64 // Instruction after which the lines changed
+	lines        IEEE488
+}
+
+// EnableHistory starts recording history so that execution can be reversed
+func (c *CBM2031) EnableHistory() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.history = &History{}
+	c.checkpoint()
+}
+
+// Instructions returns the number of instructions executed
+func (c *CBM2031) Instructions() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.instructions
+}
+
+// StepBack reverses execution by n instructions. The drive must be paused.
+func (c *CBM2031) StepBack(n int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.running && !c.paused {
+		return ErrRunning
+	}
+	if uint64(n) > c.instructions {
+		return ErrNoHistory
+	}
+	target := c.instructions - uint64(n)
+
+	return c.rewind(func(cp checkpoint) bool {
+		return cp.instructions <= target
+	}, func() bool {
+		return c.instructions < target
+	})
+}
+
+/*
+RewindTo reverses execution to the first instruction boundary at or after
+cycle. The drive must be paused.
+*/
+func (c *CBM2031) RewindTo(cycle uint64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.running && !c.paused {
+		return ErrRunning
+	}
+	if cycle > c.Cycles() {
+		return fmt.Errorf("cycle %d is in the future", cycle)
+	}
+
+	return c.rewind(func(cp checkpoint) bool {
+		return cp.snapshot.Cycles <= cycle
+	}, func() bool {
+		return c.Cycles() < cycle
+	})
+}
+
+/*
+Restore the latest checkpoint that is before the target, then execute
+instructions until the target is reached
+*/
+func (c *CBM2031) rewind(before func(checkpoint) bool, more func() bool) error {
+	h := c.history
+	if h == nil {
+		return errors.New("history is not enabled")
+	}
+
+	n := len(h.checkpoints) - 1
+	for n >= 0 && !before(h.checkpoints[n]) {
+		n--
+	}
+	if n < 0 {
+		return ErrNoHistory
+	}
+	cp := h.checkpoints[n]
+
+	if c.instructions > h.end {
+		h.end = c.instructions
+	}
+	err := c.restore(cp.snapshot)
+	if err != nil {
+		return err
+	}
+	c.instructions = cp.instructions
+	h.replayed = cp.snapshot.Bus
+	c.calls = append([]Byte(nil), cp.calls...)
+
+	h.next = 0
+	for h.next < len(h.inputs) && h.inputs[h.next].instructions <= cp.instructions {
+		h.next++
+	}
+
+	for more() {
+		err := c.execute()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Discard the history & start recording afresh, after the drive was changed in a
+way that re-execution can't reproduce
+*/
+func (c *CBM2031) restartHistory() {
+	if c.history != nil {
+		c.history = &History{}
+		c.checkpoint()
+	}
+}
+
+// Take a checkpoint & discard the oldest if there are too many
+func (c *CBM2031) checkpoint() {
+	h := c.history
+
+	cp := checkpoint{
+		instructions: c.instructions,
+		snapshot:     c.snapshot(),
+		calls:        append([]Byte(nil), c.calls...),
+	}
+	h.checkpoints = append(h.checkpoints, cp)
+	if len(h.checkpoints) <= CHECKPOINT_COUNT {
+		return
+	}
+	h.checkpoints = h.checkpoints[1:]
+
+	// Inputs before the oldest checkpoint can never be replayed
+	oldest := h.checkpoints[0].instructions
+	n := 0
+	for n < len(h.inputs) && h.inputs[n].instructions <= oldest {
+		n++
+	}
+	h.inputs = h.inputs[n:]
+	h.next -= n
+	if h.next < 0 {
+		h.next = 0
+	}
+}
+
+// Replaying returns true while instructions are being re-executed
+func (h *History) replaying(instructions uint64) bool {
+	return instructions <= h.end
+}
+
+// Record the state of the bus after an instruction, if it changed
+func (h *History) record(instructions uint64, lines IEEE488) {
+	h.end = instructions
+	if h.recorded && lines == h.last {
+		return
+	}
+	h.inputs = append(h.inputs, input{instructions, lines})
+	h.next = len(h.inputs)
+	h.last = lines
+	h.recorded = true
+}
+
+// Return the bus state recorded after an instruction
+func (h *History) replay(instructions uint64) IEEE488 {
+	if h.next < len(h.inputs) && h.inputs[h.next].instructions == instructions {
+		h.replayed = h.inputs[h.next].lines
+		h.next++
+	}
+	return h.replayed
+}
+
+// Sync the bus, or feed the drive the recorded bus state when re-executing
+func (c *CBM2031) syncBus() IEEE488 {
+	h := c.history
+
+	switch {
+	case c.port == nil:
+		// Nothing drives the lines, but the jumpers are still read
+		c.lines = MakeIEEE488()
+		c.CreateConnector().Write(c.lines)
+	case h != nil && h.replaying(c.instructions):
+		// Written after every instruction, as it is when the bus is live
+		c.lines = h.replay(c.instructions)
+		c.CreateConnector().Write(c.lines)
+	default:
+		c.lines = c.port.Sync()
+		if h != nil {
+			h.record(c.instructions, c.lines)
+		}
+	}
+	return c.lines
+}
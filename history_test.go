@@ -0,0 +1,215 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Create a booting drive connected to a host, with history enabled
+func newHistoryDrive() (*CBM2031, *DummyConnector) {
+	host := &DummyConnector{}
+	host.Reset()
+
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+	bus := &IEEEBus{}
+	bus.Attach(host)
+	c.Connect(bus)
+	c.EnableHistory()
+
+	return c, host
+}
+
+// Compare the drive with a snapshot
+func checkState(t *testing.T, c *CBM2031, want *Snapshot) {
+	t.Helper()
+
+	got := c.Snapshot()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("state at cycle %d, PC $%04x does not match cycle %d, PC $%04x",
+			got.Cycles, got.CPU.PC, want.Cycles, want.CPU.PC)
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	c, host := newHistoryDrive()
+
+	err := c.Step(200000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := c.Snapshot()
+	wantInstructions := c.Instructions()
+
+	// The drive responds to ATN from the host
+	host.Update(func(out *IEEE488) { out.ATN = TRUE })
+	err = c.Step(50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := c.Snapshot()
+
+	err = c.StepBack(50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Instructions(); n != wantInstructions {
+		t.Errorf("instructions = %d after stepping back, want %d", n, wantInstructions)
+	}
+	checkState(t, c, want)
+
+	// Re-execution uses the recorded bus, not the live host
+	host.Update(func(out *IEEE488) { out.ATN = FALSE })
+	err = c.Step(50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, c, end)
+}
+
+// Rewinding across IFC replays the cycles the drive was held in reset
+func TestStepBackAcrossIFC(t *testing.T) {
+	c, host := newHistoryDrive()
+
+	err := c.Step(150000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := c.Snapshot()
+	start := c.Instructions()
+
+	// Pulse IFC
+	host.Update(func(out *IEEE488) { out.IFC = TRUE })
+	err = c.Step(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Update(func(out *IEEE488) { out.IFC = FALSE })
+	err = c.Step(50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := c.Snapshot()
+	end := c.Instructions()
+
+	// Rewind while IFC is held again
+	host.Update(func(out *IEEE488) { out.IFC = TRUE })
+	err = c.Step(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Snapshot().Held {
+		t.Fatal("snapshot taken while IFC is asserted isn't held in reset")
+	}
+	err = c.StepBack(int(c.Instructions() - start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.InReset() {
+		t.Error("still held in reset after rewinding to before IFC")
+	}
+	checkState(t, c, before)
+
+	// Re-execution holds the drive in reset for the recorded cycles
+	err = c.Step(int(end - start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, c, after)
+}
+
+func TestRewindTo(t *testing.T) {
+	c, _ := newHistoryDrive()
+
+	err := c.Step(100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := c.Snapshot()
+
+	err = c.Step(100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.RewindTo(want.Cycles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, c, want)
+}
+
+func TestStepBackTooFar(t *testing.T) {
+	c, _ := newHistoryDrive()
+
+	err := c.Step(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StepBack(11); err != ErrNoHistory {
+		t.Errorf("StepBack past reset returned %v, want ErrNoHistory", err)
+	}
+}
+
+// Checkpoints keep being taken while the bus is recorded
+func TestHistoryCheckpoints(t *testing.T) {
+	c, _ := newHistoryDrive()
+
+	err := c.Step(300000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.history.checkpoints); n < 2 {
+		t.Errorf("%d checkpoints after %d cycles, want more than one", n, c.Cycles())
+	}
+}
+
+// Changing a register discards the history that replay would get wrong
+func TestSetRegisterRestartsHistory(t *testing.T) {
+	c, _ := newHistoryDrive()
+
+	err := c.Step(150000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.StepBack(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.SetRegister("x", 0x12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StepBack(1); err != ErrNoHistory {
+		t.Errorf("StepBack past the change returned %v, want ErrNoHistory", err)
+	}
+
+	// History recorded after the change replays it
+	want := c.Snapshot()
+	err = c.Step(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.StepBack(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, c, want)
+}
+
+func TestPokeRestartsHistory(t *testing.T) {
+	c, _ := newHistoryDrive()
+
+	err := c.Step(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Poke(0x0300, 0x55)
+	if got := c.Peek(0x0300); got != 0x55 {
+		t.Errorf("$0300 = $%02x after poke, want $55", got)
+	}
+	if err := c.StepBack(1); err != ErrNoHistory {
+		t.Errorf("StepBack past the poke returned %v, want ErrNoHistory", err)
+	}
+}
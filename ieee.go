@@ -1,6 +1,9 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 type IEEEBool int
 
@@ -66,7 +69,16 @@ func IEEEBoolFromBool(b bool) IEEEBool {
 	return FALSE
 }
 
-/* IEEE488 models a cable that contains the signals for an IEEE488 interface */
+/*
+IEEE488 models the signals for an IEEE488 interface. The lines are open
+collector: each participant either asserts a line by pulling it low, or
+releases it. A line that nobody asserts is pulled high by the pull-up
+resistors, so the bus never floats even though an output may.
+
+Data is negative logic too. DIO holds a 1 for each data line that is pulled
+low, which is the value of the data byte; DIOFromTTL & DIOToTTL convert to &
+from the TTL levels on a device's port.
+*/
 type IEEE488 struct {
 	DAV  IEEEBool /* Data Valid */
 	EOI  IEEEBool /* End or Identity */
@@ -77,7 +89,7 @@ type IEEE488 struct {
 	REN  IEEEBool /* Remote Enable */
 	IFC  IEEEBool /* Interface Clear */
 
-	DIO Byte /* Data */
+	DIO Byte /* Data lines asserted */
 }
 
 func (i IEEE488) Dump() {
@@ -94,59 +106,44 @@ func (i IEEE488) Dump() {
 }
 
 /*
-When all participants write 0 (false), the line will read back 0, but if any
-device writes 1 (true), the bus will read back as 1.
-
-0V = TRUE/1 (IEEE) = 0 (TTL Low)
-5V = FALSE/0 (IEEE) = 1 (TTL High)
+Or combines the outputs of two participants. A line is TRUE (0V) if either
+asserts it; otherwise it is released & the pull-up makes it FALSE (5V). An
+output that is FLOATING is not driving the line, so it is released.
 */
 func (i IEEE488) Or(o IEEE488) IEEE488 {
-	var out IEEE488
-
-	if i.DAV == TRUE || o.DAV == TRUE {
-		out.DAV = TRUE
-	} else {
-		out.DAV = FALSE
-	}
-	if i.EOI == TRUE || o.EOI == TRUE {
-		out.EOI = TRUE
-	} else {
-		out.EOI = FALSE
-	}
-	if i.NDAC == TRUE || o.NDAC == TRUE {
-		out.NDAC = TRUE
-	} else {
-		out.NDAC = FALSE
-	}
-	if i.NRFD == TRUE || o.NRFD == TRUE {
-		out.NRFD = TRUE
-	} else {
-		out.NRFD = FALSE
-	}
-	if i.SRQ == TRUE || o.SRQ == TRUE {
-		out.SRQ = TRUE
-	} else {
-		out.SRQ = FALSE
-	}
-	if i.ATN == TRUE || o.ATN == TRUE {
-		out.ATN = TRUE
-	} else {
-		out.ATN = FALSE
-	}
-	if i.REN == TRUE || o.REN == TRUE {
-		out.REN = TRUE
-	} else {
-		out.REN = FALSE
+	return IEEE488{
+		DAV:  wiredOr(i.DAV, o.DAV),
+		EOI:  wiredOr(i.EOI, o.EOI),
+		NDAC: wiredOr(i.NDAC, o.NDAC),
+		NRFD: wiredOr(i.NRFD, o.NRFD),
+		SRQ:  wiredOr(i.SRQ, o.SRQ),
+		ATN:  wiredOr(i.ATN, o.ATN),
+		REN:  wiredOr(i.REN, o.REN),
+		IFC:  wiredOr(i.IFC, o.IFC),
+		DIO:  i.DIO | o.DIO,
 	}
-	if i.IFC == TRUE || o.IFC == TRUE {
-		out.IFC = TRUE
-	} else {
-		out.IFC = FALSE
+}
+
+// The level of an open collector line driven by two outputs
+func wiredOr(a, b IEEEBool) IEEEBool {
+	if a == TRUE || b == TRUE {
+		return TRUE
 	}
+	return FALSE
+}
 
-	out.DIO = i.DIO | o.DIO
+/*
+DIOFromTTL converts the TTL levels output on a port to the data lines the
+device asserts. Only the bits set in outputs are driven; a pin that is low
+pulls its data line low.
+*/
+func DIOFromTTL(ttl, outputs Byte) Byte {
+	return ^ttl & outputs
+}
 
-	return out
+// DIOToTTL converts the data lines to the TTL levels seen on a port
+func DIOToTTL(dio Byte) Byte {
+	return ^dio
 }
 
 func MakeIEEE488() IEEE488 {
@@ -172,21 +169,180 @@ type Connector interface {
 }
 
 /*
-Cables connect two Connectors at the A & B end
+ATNResponder is a Connector with hardware that answers ATN by itself, such as
+the drive's ATN acknowledge gates. Its outputs are read for both states of
+ATN & the bus picks between them whenever it is synced, as a participant that
+has yet to sync would still answer ATN straight away. ATN itself must be the
+same in both.
+*/
+type ATNResponder interface {
+	Connector
+	ReadATN() (released, asserted IEEE488)
+}
+
+/*
+IEEEBus joins any number of Connectors. Each line is the wired-OR of what
+every participant drives onto it.
+
+Participants that run in their own goroutine, such as drives, are connected
+with Connect & call Sync on their port to publish their outputs & receive the
+state of the bus. They only ever touch their own device, so drives running in
+separate goroutines can share a bus. Passive participants are connected with
+Attach & are synced whenever any port is synced.
+*/
+type IEEEBus struct {
+	mutex sync.Mutex
+	ports []*BusPort
+	taps  []*Analyzer
+}
+
+// BusPort is a participant's connection to the bus
+type BusPort struct {
+	Clock func() uint64 // Timestamps changes to the bus for analyzers, if set
+
+	bus       *IEEEBus
+	connector Connector
+	passive   bool
+	out       IEEE488 // Lines driven by the participant at its last sync
+	outATN    IEEE488 // Lines it drives while ATN is asserted
+}
+
+// Connect a participant that syncs its own port
+func (b *IEEEBus) Connect(c Connector) *BusPort {
+	return b.add(c, false)
+}
+
+// Attach a passive participant, which is synced along with every other port
+func (b *IEEEBus) Attach(c Connector) *BusPort {
+	return b.add(c, true)
+}
+
+func (b *IEEEBus) add(c Connector, passive bool) *BusPort {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	p := &BusPort{
+		bus:       b,
+		connector: c,
+		passive:   passive,
+		out:       MakeIEEE488(),
+		outATN:    MakeIEEE488(),
+	}
+	b.ports = append(b.ports, p)
+
+	return p
+}
+
+// Disconnect removes a participant from the bus
+func (b *IEEEBus) Disconnect(p *BusPort) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for n, port := range b.ports {
+		if port == p {
+			b.ports = append(b.ports[:n], b.ports[n+1:]...)
+			return
+		}
+	}
+}
+
+/*
+Tap an analyzer onto the bus, which records the lines whenever they change.
+Tapping an analyzer that is already on the bus has no effect.
 */
-type Cable struct {
-	A Connector
-	B Connector
+func (b *IEEEBus) Tap(a *Analyzer) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, tap := range b.taps {
+		if tap == a {
+			return
+		}
+	}
+	b.taps = append(b.taps, a)
 }
 
-func (c *Cable) Sync() {
-	aEnd := c.A.Read()
-	bEnd := c.B.Read()
+// Untap removes an analyzer from the bus
+func (b *IEEEBus) Untap(a *Analyzer) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
-	// OR the states together
-	combined := aEnd.Or(bEnd)
+	for n, tap := range b.taps {
+		if tap == a {
+			b.taps = append(b.taps[:n], b.taps[n+1:]...)
+			return
+		}
+	}
+}
+
+// Lines returns the state of the bus as of the last sync of each participant
+func (b *IEEEBus) Lines() IEEE488 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.lines()
+}
+
+func (b *IEEEBus) lines() IEEE488 {
+	lines := MakeIEEE488()
+	for _, p := range b.ports {
+		lines = lines.Or(p.out)
+	}
+	if lines.ATN != TRUE {
+		return lines
+	}
+
+	lines = MakeIEEE488()
+	for _, p := range b.ports {
+		lines = lines.Or(p.outATN)
+	}
+	return lines
+}
+
+// Read the participant's outputs for both states of ATN
+func (p *BusPort) read() (IEEE488, IEEE488) {
+	if r, ok := p.connector.(ATNResponder); ok {
+		return r.ReadATN()
+	}
+	out := p.connector.Read()
+	return out, out
+}
+
+// Sync publishes the participant's outputs, then delivers the state of the bus to it
+func (p *BusPort) Sync() IEEE488 {
+	out, outATN := p.read()
+
+	b := p.bus
+	b.mutex.Lock()
+	p.out, p.outATN = out, outATN
+	for _, q := range b.ports {
+		if q.passive {
+			q.out, q.outATN = q.read()
+		}
+	}
+	lines := b.lines()
+	for _, q := range b.ports {
+		if q.passive {
+			q.connector.Write(lines)
+		}
+	}
+	if len(b.taps) > 0 {
+		var cycle uint64
+		if p.Clock != nil {
+			cycle = p.Clock()
+		}
+		for _, a := range b.taps {
+			a.sample(cycle, lines)
+		}
+	}
+	b.mutex.Unlock()
+
+	p.connector.Write(lines)
+
+	return lines
+}
 
-	// Write the combined state to both ends
-	c.A.Write(combined)
-	c.B.Write(combined)
+// Lines returns the state of the bus the port is connected to
+func (p *BusPort) Lines() IEEE488 {
+	return p.bus.Lines()
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vanders/pet/mos6502"
+)
+
+func TestBusWiredOr(t *testing.T) {
+	bus := &IEEEBus{}
+
+	var connectors [3]*DummyConnector
+	var ports [3]*BusPort
+	for n := range connectors {
+		connectors[n] = &DummyConnector{}
+		connectors[n].Reset()
+		ports[n] = bus.Connect(connectors[n])
+	}
+
+	// Nothing driven
+	for _, p := range ports {
+		p.Sync()
+	}
+	if lines := bus.Lines(); lines.ATN != FALSE || lines.NRFD != FALSE {
+		t.Errorf("idle bus: ATN %s, NRFD %s; want both false", lines.ATN, lines.NRFD)
+	}
+
+	// One participant asserting a line is enough
+	connectors[0].Update(func(out *IEEE488) { out.ATN = TRUE })
+	connectors[2].Update(func(out *IEEE488) { out.NRFD = TRUE })
+	ports[0].Sync()
+	ports[2].Sync()
+	lines := ports[1].Sync()
+	if lines.ATN != TRUE || lines.NRFD != TRUE || lines.NDAC != FALSE {
+		t.Errorf("ATN %s, NRFD %s, NDAC %s; want true, true, false", lines.ATN, lines.NRFD, lines.NDAC)
+	}
+	if connectors[1].In().ATN != TRUE {
+		t.Error("ATN was not delivered to the other participants")
+	}
+
+	// The line is released once every participant releases it
+	connectors[2].Update(func(out *IEEE488) { out.NRFD = FALSE })
+	ports[2].Sync()
+	if lines := bus.Lines(); lines.NRFD != FALSE {
+		t.Errorf("NRFD %s after release, want false", lines.NRFD)
+	}
+
+	bus.Disconnect(ports[0])
+	if lines := ports[1].Sync(); lines.ATN != FALSE {
+		t.Errorf("ATN %s after disconnecting the participant driving it, want false", lines.ATN)
+	}
+}
+
+func TestBusPassive(t *testing.T) {
+	bus := &IEEEBus{}
+
+	host := &DummyConnector{}
+	host.Reset()
+	bus.Attach(host)
+
+	active := &DummyConnector{}
+	active.Reset()
+	port := bus.Connect(active)
+
+	host.Update(func(out *IEEE488) { out.ATN = TRUE })
+	port.Sync()
+	if active.In().ATN != TRUE {
+		t.Error("passive participant's ATN not seen by the active participant")
+	}
+
+	active.Update(func(out *IEEE488) { out.NDAC = TRUE })
+	port.Sync()
+	if host.In().NDAC != TRUE {
+		t.Error("active participant's NDAC not delivered to the passive participant")
+	}
+}
+
+func TestOpenCollector(t *testing.T) {
+	// A floating output doesn't drive the line, so the pull-up wins
+	for _, out := range []IEEEBool{FALSE, FLOATING} {
+		lines := MakeIEEE488().Or(IEEE488{ATN: out, NRFD: out})
+		if lines.ATN != FALSE || lines.NRFD != FALSE {
+			t.Errorf("%s output: ATN %s, NRFD %s; want both false", out, lines.ATN, lines.NRFD)
+		}
+	}
+
+	// Any participant pulling a data line low asserts it
+	if dio := (IEEE488{DIO: 0x0f}).Or(IEEE488{DIO: 0x81}).DIO; dio != 0x8f {
+		t.Errorf("DIO $%02x, want $8f", dio)
+	}
+}
+
+func TestDriveConnectorLines(t *testing.T) {
+	via := &VIA{}
+	c := CBM2031Connector{Via: via}
+
+	// The ROM outputs the inverse of each data byte, as the lines are active low
+	via.WriteRegister(PORT_A_DIR, 0xff)
+	via.WriteRegister(PORT_A, ^Byte(0x41))
+	if dio := c.Read().DIO; dio != 0x41 {
+		t.Errorf("DIO $%02x, want $41", dio)
+	}
+	c.Write(IEEE488{DIO: 0x28})
+	via.WriteRegister(PORT_A_DIR, 0x00)
+	if pins := via.ReadRegister(PORT_A); pins != ^Byte(0x28) {
+		t.Errorf("port A $%02x, want $%02x", pins, ^Byte(0x28))
+	}
+
+	// NRFD is driven while NDAC is an input
+	via.WriteRegister(PORT_B_DIR, mos6502.BIT_1)
+	via.WriteRegister(PORT_B, 0)
+	out := c.Read()
+	if out.NRFD != TRUE || out.NDAC != FLOATING {
+		t.Errorf("NRFD %s, NDAC %s; want true, floating", out.NRFD, out.NDAC)
+	}
+}
+
+/*
+A drive that has acknowledged ATN holds NDAC & NRFD as soon as ATN is released,
+before it next syncs, as the acknowledge gates don't wait for the CPU
+*/
+func TestBusATNAcknowledge(t *testing.T) {
+	bus := &IEEEBus{}
+	host := &DummyConnector{}
+	host.Reset()
+	bus.Attach(host)
+
+	via := &VIA{}
+	port := bus.Connect(CBM2031Connector{Via: via})
+
+	other := &DummyConnector{}
+	other.Reset()
+	otherPort := bus.Connect(other)
+
+	// NDAC & NRFD released, with ATNA set to acknowledge ATN
+	via.WriteRegister(PORT_B_DIR, mos6502.BIT_0|mos6502.BIT_1|mos6502.BIT_2)
+	via.WriteRegister(PORT_B, mos6502.BIT_0|mos6502.BIT_1|mos6502.BIT_2)
+	host.Update(func(out *IEEE488) { out.ATN = TRUE })
+	port.Sync()
+	if lines := bus.Lines(); lines.NDAC != FALSE || lines.NRFD != FALSE {
+		t.Errorf("ATN acknowledged: NDAC %s, NRFD %s; want both false", lines.NDAC, lines.NRFD)
+	}
+
+	// Only the other participant syncs, so the drive's outputs are as they were
+	host.Update(func(out *IEEE488) { out.ATN = FALSE })
+	otherPort.Sync()
+	if lines := host.In(); lines.NDAC != TRUE || lines.NRFD != TRUE {
+		t.Errorf("ATN released: NDAC %s, NRFD %s; want both true", lines.NDAC, lines.NRFD)
+	}
+}
+
+// Several drives can share a bus, each running in its own goroutine
+func TestBusMultipleDrives(t *testing.T) {
+	devices := []int{MIN_DEVICE, MIN_DEVICE + 1, MIN_DEVICE + 2}
+	c, drives := newControlledBus(t, devices...)
+
+	// Only the addressed drive gets the command
+	sendCommand(t, c, devices[1], "Z")
+	for _, d := range drives {
+		settle(t, d)
+	}
+
+	for n, device := range devices {
+		want := "73,CBM DOS V2.6 2031,00,00\r"
+		if n == 1 {
+			want = "31,SYNTAX ERROR,00,00\r"
+		}
+		if got := readChannel(t, c, device, 15); got != want {
+			t.Errorf("device %d: status %q, want %q", device, got, want)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/vanders/pet/mos6502"
 )
@@ -18,37 +21,137 @@ func sep() {
 	fmt.Println("========================================")
 }
 
+// patchFiles collects repeated -p flags
+type patchFiles []string
+
+func (p *patchFiles) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patchFiles) Set(filename string) error {
+	*p = append(*p, filename)
+	return nil
+}
+
 func main() {
 	var (
-		writer io.Writer
+		writer  io.Writer
+		patches patchFiles
 	)
 	debug := flag.Bool("d", false, "enable CPU dissasembly")
+	flag.Var(&patches, "p", "apply ROM patch file (may be repeated)")
+	warp := flag.Bool("w", false, "start in warp mode (unthrottled)")
+	snapshot := flag.String("s", "", "restore a snapshot file at startup")
+	history := flag.Bool("r", false, "record history for reverse execution")
+	crashReport := flag.String("c", "cbm2031-crash.txt", "crash report file (empty to disable)")
+	labels := flag.String("l", "", "load a VICE label file for the disassembler")
+	profile := flag.String("P", "", "profile execution & write a coverage report (JSON if it ends .json)")
+	vcd := flag.String("a", "", "record the bus with the logic analyzer & write it to a VCD file on exit")
+	device := flag.Int("n", DEFAULT_DEVICE, fmt.Sprintf("device number (%d-%d)", MIN_DEVICE, MAX_DEVICE))
 	flag.Parse()
 
 	if *debug {
 		writer = os.Stderr
 	}
 
-	// Dummy 'A' end connector
+	// Dummy connector for the monitor
 	aConnector := &DummyConnector{}
 	aConnector.Reset()
 	monitor := NewMonitor(aConnector)
 
 	// Create a new CBM2031
-	cbm2031 := NewCBM2031(writer)
+	cbm2031, err := NewCBM2031(writer, *device)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Patch the ROMs
+	for _, filename := range patches {
+		p, err := LoadPatchFile(filename)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		err = cbm2031.ApplyPatches(p)
+		if err != nil {
+			fmt.Printf("%s: %s\n", filename, err)
+			os.Exit(1)
+		}
+	}
 
-	// Connect a cable to the "B" end
-	bConnector := cbm2031.CreateConnector()
+	// Connect the drive & the monitor to the bus
+	bus := &IEEEBus{}
+	bus.Attach(aConnector)
+	cbm2031.Connect(bus)
+	cbm2031.Throttle.SetWarp(*warp)
+	monitor.Throttle = cbm2031.Throttle
+	monitor.Drive = cbm2031
+	monitor.Bus = bus
+	cbm2031.CrashReport = *crashReport
 
-	// Create a cable & connect the 'A' & 'B' ends
-	cable := &Cable{
-		A: aConnector,
-		B: bConnector,
+	if *labels != "" {
+		symbols, err := LoadSymbols(*labels)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		monitor.SetSymbols(symbols)
+	}
+	if *profile != "" {
+		cbm2031.EnableProfiler()
 	}
-	cbm2031.Cable = cable
-	monitor.BVIA = cbm2031.VIA
-	monitor.BRAM = cbm2031.RAM
+	if *vcd != "" {
+		monitor.Analyzer = NewAnalyzer()
+		bus.Tap(monitor.Analyzer)
+	}
+	if *history {
+		cbm2031.EnableHistory()
+	}
+	if *snapshot != "" {
+		err := cbm2031.LoadSnapshotFile(*snapshot)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	// Stop the drive when the monitor exits
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- cbm2031.Run(ctx)
+	}()
+
+	go func() {
+		monitor.Run()
+		cancel()
+	}()
 
-	go cbm2031.Run()
-	monitor.Run()
+	err = <-done
+	if *profile != "" {
+		report, perr := cbm2031.ProfileReport(monitor.Symbols())
+		if perr == nil {
+			perr = report.WriteFile(*profile)
+		}
+		if perr != nil {
+			fmt.Println(perr)
+		}
+	}
+	if *vcd != "" {
+		verr := monitor.Analyzer.WriteVCDFile(*vcd)
+		if verr != nil {
+			fmt.Println(verr)
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	fmt.Printf("\n%s\n", err)
+	var execErr *ExecutionError
+	if errors.As(err, &execErr) && execErr.Report != "" {
+		fmt.Printf("crash report written to %s\n", execErr.Report)
+	}
+	cbm2031.Dump()
+	os.Exit(1)
 }
@@ -2,119 +2,71 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
-// DummyConnector is a do-nothing stub
-type DummyConnector struct {
-	In struct {
-		DAV  IEEEBool
-		EOI  IEEEBool
-		NDAC IEEEBool
-		NRFD IEEEBool
-		SRQ  IEEEBool
-		ATN  IEEEBool
-		REN  IEEEBool
-		IFC  IEEEBool
+// No secondary address was given
+const NO_SECONDARY = -1
 
-		DIO Byte
-	}
-	Out struct {
-		DAV  IEEEBool
-		EOI  IEEEBool
-		NDAC IEEEBool
-		NRFD IEEEBool
-		SRQ  IEEEBool
-		ATN  IEEEBool
-		REN  IEEEBool
-		IFC  IEEEBool
+type Monitor struct {
+	A        *DummyConnector
+	Throttle *Throttle
+	Drive    *CBM2031
+	Bus      *IEEEBus
+	Analyzer *Analyzer
 
-		DIO Byte
-	}
-}
+	controller *Controller
 
-func (c *DummyConnector) Reset() {
-	c.Out.DAV = FLOATING
-	c.Out.EOI = FLOATING
-	c.Out.NDAC = FLOATING
-	c.Out.NRFD = FLOATING
-	c.Out.SRQ = FLOATING
-	c.Out.ATN = FLOATING
-	c.Out.REN = FLOATING
-	c.Out.IFC = FLOATING
+	symbolsMutex sync.Mutex // The labels command replaces the symbols while main may read them
+	symbols      *Symbols
+
+	disNext Word // Where the next dis without an address continues from
+	disPC   Word // PC when disNext was set. Once execution moves on dis starts at the PC.
+	disSet  bool
 }
 
-func (c *DummyConnector) Read() IEEE488 {
-	return IEEE488{
-		ATN:  c.Out.ATN,
-		NRFD: c.Out.NRFD,
-		NDAC: c.Out.NDAC,
-		EOI:  c.Out.EOI,
-		DAV:  c.Out.DAV,
-		REN:  c.Out.REN,
-		SRQ:  c.Out.SRQ,
-		IFC:  c.Out.IFC,
-		DIO:  ^c.Out.DIO, // We must invert DIO before writing it
+func NewMonitor(connector *DummyConnector) *Monitor {
+	return &Monitor{
+		A:          connector,
+		controller: NewController(connector),
 	}
 }
 
-func (c *DummyConnector) Write(i IEEE488) {
-	c.In.ATN = i.ATN
-	c.In.NRFD = i.NRFD
-	c.In.NDAC = i.NDAC
-	c.In.EOI = i.EOI
-	c.In.DAV = i.DAV
-	c.In.REN = i.REN
-	c.In.SRQ = i.SRQ
-	c.In.IFC = i.IFC
-	c.In.DIO = ^i.DIO // DIO in comes to us inverted (0v = 1, 5v = 0) so invert it back to a normal byte
-}
+// Symbols returns the labels loaded for the disassembler, if any
+func (m *Monitor) Symbols() *Symbols {
+	m.symbolsMutex.Lock()
+	defer m.symbolsMutex.Unlock()
 
-func (c *DummyConnector) Dump() {
-	fmt.Println("IN")
-	fmt.Printf("ATN: %s, NRFD: %s, NDAC: %s, EOI: %s, DAV: %s\n",
-		c.In.ATN.ToOnOff(),
-		c.In.NRFD.ToOnOff(),
-		c.In.NDAC.ToOnOff(),
-		c.In.EOI.ToOnOff(),
-		c.In.DAV.ToOnOff())
-	fmt.Printf("DATA: 0x%02x (Inverted from 0x%02x)\n", c.In.DIO, ^c.In.DIO)
-	//fmt.Printf("REN: %t, SRQ: %t, IFC: %t\n", c.In.REN, c.In.SRQ, c.In.IFC)
-	fmt.Println("")
-	fmt.Println("OUT")
-	fmt.Printf("ATN: %s, NRFD: %s, NDAC: %s, EOI: %s, DAV: %s\n",
-		c.Out.ATN.ToOnOff(),
-		c.Out.NRFD.ToOnOff(),
-		c.Out.NDAC.ToOnOff(),
-		c.Out.EOI.ToOnOff(),
-		c.Out.DAV.ToOnOff())
-	//fmt.Printf("REN: %t, SRQ: %t, IFC: %t\n", c.Out.REN, c.Out.SRQ, c.Out.IFC)
-	fmt.Printf("DATA: 0x%02x (Inverted from 0x%02x)\n", ^c.Out.DIO, c.Out.DIO)
+	return m.symbols
 }
 
-type Monitor struct {
-	A    *DummyConnector
-	BVIA *VIA
-	BRAM *RAM
-}
+func (m *Monitor) SetSymbols(symbols *Symbols) {
+	m.symbolsMutex.Lock()
+	defer m.symbolsMutex.Unlock()
 
-func NewMonitor(connector *DummyConnector) *Monitor {
-	return &Monitor{
-		A: connector,
-	}
+	m.symbols = symbols
 }
 
 func (m *Monitor) Run() {
+	if m.Drive != nil {
+		go m.reportStops()
+	}
+
 	// Read input
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("> ")
-		input, _ := reader.ReadString('\n')
+		input, err := reader.ReadString('\n')
+		if err != nil && input == "" {
+			return
+		}
 
 		args := strings.Split(strings.Trim(input, "\r\n"), " ")
 		if len(args) == 0 {
@@ -123,33 +75,39 @@ func (m *Monitor) Run() {
 
 		switch args[0] {
 		case "exit":
-			os.Exit(0)
+			return
 		case "dump":
 			m.A.Dump()
 		case "via":
 			switch args[1] {
 			case "a":
-				fmt.Printf("Port A: $%02x\n", m.BVIA.PeekRegister(PORT_A))
+				fmt.Printf("Port A: $%02x\n", m.Drive.PeekVIA(PORT_A))
 			case "adir":
-				fmt.Printf("Port A Dir: %02x\n", m.BVIA.PeekRegister(PORT_A_DIR))
+				fmt.Printf("Port A Dir: %02x\n", m.Drive.PeekVIA(PORT_A_DIR))
 			case "b":
-				fmt.Printf("Port B: $%02x\n", m.BVIA.PeekRegister(PORT_B))
+				fmt.Printf("Port B: $%02x\n", m.Drive.PeekVIA(PORT_B))
 			case "bdir":
-				fmt.Printf("Port B Dir: %02x\n", m.BVIA.PeekRegister(PORT_B_DIR))
+				fmt.Printf("Port B Dir: %02x\n", m.Drive.PeekVIA(PORT_B_DIR))
 			case "t1lo", "t1low":
-				fmt.Printf("Timer 1 Low: %02x\n", m.BVIA.PeekRegister(TIMER_1_LOW))
+				fmt.Printf("Timer 1 Low: %02x\n", m.Drive.PeekVIA(TIMER_1_LOW))
 			case "t1hi", "t1high":
-				fmt.Printf("Timer 1 High: %02x\n", m.BVIA.PeekRegister(TIMER_1_HIGH))
+				fmt.Printf("Timer 1 High: %02x\n", m.Drive.PeekVIA(TIMER_1_HIGH))
+			case "t2lo", "t2low":
+				fmt.Printf("Timer 2 Low: %02x\n", m.Drive.PeekVIA(TIMER_2_LOW))
+			case "t2hi", "t2high":
+				fmt.Printf("Timer 2 High: %02x\n", m.Drive.PeekVIA(TIMER_2_HIGH))
+			case "sr":
+				fmt.Printf("SR: %02x\n", m.Drive.PeekVIA(SHIFT))
 			case "ifr":
-				fmt.Printf("IFR: %02x\n", m.BVIA.PeekRegister(INT_FLAGS))
+				fmt.Printf("IFR: %02x\n", m.Drive.PeekVIA(INT_FLAGS))
 			case "ie":
-				fmt.Printf("IE: %02x\n", m.BVIA.PeekRegister(INT_ENABLE))
+				fmt.Printf("IE: %02x\n", m.Drive.PeekVIA(INT_ENABLE))
 			case "acr":
-				fmt.Printf("ACR: %02x\n", m.BVIA.PeekRegister(AUXILLERY_CTRL))
+				fmt.Printf("ACR: %02x\n", m.Drive.PeekVIA(AUXILLERY_CTRL))
 			case "pcr":
-				fmt.Printf("PCR: %02x\n", m.BVIA.PeekRegister(PERIPHERAL_CTRL))
+				fmt.Printf("PCR: %02x\n", m.Drive.PeekVIA(PERIPHERAL_CTRL))
 			case "irq":
-				fmt.Printf("IRQ: %t\n", m.BVIA.CheckInterrupt())
+				fmt.Printf("IRQ: %t\n", m.Drive.VIAInterrupt())
 			}
 		case "peek":
 			if len(args) != 2 {
@@ -158,10 +116,10 @@ func (m *Monitor) Run() {
 			}
 			addr, err := strconv.ParseInt(args[1], 16, 17)
 			if err != nil {
-				fmt.Printf("invalid addr: %w", err)
+				fmt.Printf("invalid addr: %s\n", err)
 				break
 			}
-			data := m.BRAM.Read(Word(addr))
+			data := m.Drive.Peek(Word(addr))
 			fmt.Printf("$%02x: $%02x\n", addr, data)
 		case "poke":
 			if len(args) != 3 {
@@ -170,31 +128,327 @@ func (m *Monitor) Run() {
 			}
 			addr, err := strconv.ParseInt(args[1], 16, 17)
 			if err != nil {
-				fmt.Printf("invalid addr: %w", err)
+				fmt.Printf("invalid addr: %s\n", err)
 				break
 			}
 			data, err := strconv.ParseInt(args[2], 16, 9)
 			if err != nil {
-				fmt.Printf("invalid data: %w", err)
+				fmt.Printf("invalid data: %s\n", err)
 				break
 			}
-			m.BRAM.Write(Word(addr), Byte(data))
+			m.Drive.Poke(Word(addr), Byte(data))
 			fmt.Printf("$%02x: $%02x\n", addr, data)
+		case "speed":
+			if len(args) == 2 {
+				switch args[1] {
+				case "warp":
+					m.Throttle.SetWarp(true)
+				case "real":
+					m.Throttle.SetWarp(false)
+				default:
+					fmt.Println("speed [warp|real]")
+				}
+			}
+			mode := "real-time"
+			if m.Throttle.Warp() {
+				mode = "warp"
+			}
+			speed := m.Throttle.Speed()
+			fmt.Printf("%s: %.2f MHz (%.0f%%)\n", mode, speed/1e6, speed*100/CLOCK_HZ)
+		case "save":
+			if len(args) != 2 {
+				fmt.Println("save file")
+				break
+			}
+			err := m.Drive.SaveSnapshotFile(args[1])
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "load":
+			if len(args) != 2 {
+				fmt.Println("load file")
+				break
+			}
+			err := m.Drive.LoadSnapshotFile(args[1])
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "trace":
+			n := int64(20)
+			if len(args) == 2 {
+				var err error
+				n, err = strconv.ParseInt(args[1], 10, 64)
+				if err != nil {
+					fmt.Printf("invalid count: %s\n", err)
+					break
+				}
+			}
+			for _, i := range m.Drive.RecentInstructions(int(n)) {
+				fmt.Println(i)
+			}
+		case "dis":
+			addr, count := m.Drive.PC(), 16
+			if len(args) == 1 && m.disSet && addr == m.disPC {
+				addr = m.disNext
+			}
+			if len(args) > 1 {
+				a, err := m.address(args[1])
+				if err != nil {
+					fmt.Println(err)
+					break
+				}
+				addr = a
+			}
+			if len(args) > 2 {
+				n, err := strconv.Atoi(args[2])
+				if err != nil {
+					fmt.Printf("invalid count: %s\n", err)
+					break
+				}
+				count = n
+			}
+			m.disassemble(addr, count)
+		case "labels":
+			if len(args) != 2 {
+				fmt.Println("labels file")
+				break
+			}
+			symbols, err := LoadSymbols(args[1])
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			m.SetSymbols(symbols)
+		case "regs":
+			m.registers()
+		case "reg":
+			if len(args) < 2 {
+				fmt.Println("reg name=value [name=value...]")
+				break
+			}
+			err := m.setRegisters(args[1:])
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			m.registers()
+		case "profile":
+			report, err := m.Drive.ProfileReport(m.Symbols())
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if len(args) == 2 {
+				err = report.WriteFile(args[1])
+				if err != nil {
+					fmt.Println(err)
+				}
+				break
+			}
+			report.WriteText(os.Stdout)
+		case "pause":
+			m.Drive.Pause()
+			fmt.Printf("paused at $%04x\n", m.Drive.PC())
+		case "resume", "continue":
+			m.Drive.Resume()
+		case "break":
+			if len(args) == 1 {
+				for _, b := range m.Drive.Breakpoints() {
+					fmt.Println(b)
+				}
+				break
+			}
+			addr, err := strconv.ParseUint(strings.TrimPrefix(args[1], "$"), 16, 16)
+			if err != nil {
+				fmt.Printf("invalid addr: %s\n", err)
+				break
+			}
+			var conditions []Condition
+			if len(args) > 2 {
+				if args[2] != "if" || len(args) == 3 {
+					fmt.Println("break addr [if condition [&& condition...]]")
+					break
+				}
+				conditions, err = ParseConditions(strings.Join(args[3:], " "))
+				if err != nil {
+					fmt.Println(err)
+					break
+				}
+			}
+			b := m.Drive.AddBreakpoint(Word(addr), conditions)
+			fmt.Printf("breakpoint %s\n", b)
+		case "delete":
+			if len(args) != 2 {
+				fmt.Println("delete id")
+				break
+			}
+			id, err := strconv.Atoi(args[1])
+			if err != nil {
+				fmt.Printf("invalid id: %s\n", err)
+				break
+			}
+			err = m.Drive.DeleteBreakpoint(id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "step":
+			n := int64(1)
+			if len(args) == 2 {
+				var err error
+				n, err = strconv.ParseInt(args[1], 10, 64)
+				if err != nil {
+					fmt.Printf("invalid count: %s\n", err)
+					break
+				}
+			}
+			m.Drive.Pause()
+			err := m.Drive.Step(int(n))
+			if err != nil {
+				fmt.Println(err)
+			}
+			fmt.Println(m.Drive.Registers())
+		case "next":
+			m.Drive.Pause()
+			ctx, stop := interruptible()
+			err := m.Drive.StepOver(ctx)
+			stop()
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "finish":
+			m.Drive.Pause()
+			ctx, stop := interruptible()
+			err := m.Drive.Finish(ctx)
+			stop()
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "back":
+			n := int64(1)
+			if len(args) == 2 {
+				var err error
+				n, err = strconv.ParseInt(args[1], 10, 64)
+				if err != nil {
+					fmt.Printf("invalid count: %s\n", err)
+					break
+				}
+			}
+			m.Drive.Pause()
+			err := m.Drive.StepBack(int(n))
+			if err != nil {
+				fmt.Println(err)
+			}
+			fmt.Printf("paused at $%04x, instruction %d\n", m.Drive.PC(), m.Drive.Instructions())
+		case "rewind":
+			if len(args) != 2 {
+				fmt.Println("rewind cycle")
+				break
+			}
+			cycle, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				fmt.Printf("invalid cycle: %s\n", err)
+				break
+			}
+			m.Drive.Pause()
+			err = m.Drive.RewindTo(cycle)
+			if err != nil {
+				fmt.Println(err)
+			}
+			fmt.Printf("paused at $%04x, instruction %d\n", m.Drive.PC(), m.Drive.Instructions())
 		case "open":
-			err := m.open(args[1:])
+			err := m.talk(args[1:])
+			if err != nil {
+				m.controller.Abort()
+				fmt.Println(err)
+				break
+			}
+			m.controller.ReleaseATN()
+		case "analyzer":
+			if len(args) != 2 {
+				fmt.Println("analyzer start|stop|clear")
+				break
+			}
+			switch args[1] {
+			case "start":
+				if m.Analyzer == nil {
+					m.Analyzer = NewAnalyzer()
+				}
+				m.Bus.Tap(m.Analyzer)
+			case "stop":
+				if m.Analyzer != nil {
+					m.Bus.Untap(m.Analyzer)
+				}
+			case "clear":
+				if m.Analyzer != nil {
+					m.Analyzer.Clear()
+				}
+			default:
+				fmt.Println("analyzer start|stop|clear")
+			}
+			if m.Analyzer != nil {
+				fmt.Printf("%d samples recorded\n", m.Analyzer.Len())
+			}
+		case "vcd":
+			if len(args) != 2 {
+				fmt.Println("vcd file")
+				break
+			}
+			if m.Analyzer == nil {
+				fmt.Println("the analyzer has not been started")
+				break
+			}
+			err := m.Analyzer.WriteVCDFile(args[1])
 			if err != nil {
 				fmt.Println(err)
 			}
+		case "decode":
+			if m.Analyzer == nil {
+				fmt.Println("the analyzer has not been started")
+				break
+			}
+			events := Decode(m.Analyzer.Samples())
+			var err error
+			if len(args) == 1 {
+				err = WriteEventsText(os.Stdout, events)
+			} else {
+				err = WriteEventsFile(args[1], events)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "ifc":
+			if m.Drive.Paused() {
+				fmt.Println("the drive is paused & won't see IFC")
+				break
+			}
+			err := m.controller.InterfaceClear()
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			fmt.Println("IFC pulsed")
+		case "ren":
+			if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+				fmt.Println("ren on|off")
+				break
+			}
+			m.controller.RemoteEnable(args[1] == "on")
+			fmt.Printf("REN: %s\n", m.A.Out().REN.ToOnOff())
 		case "input":
-			err := m.open(args[1:])
+			err := m.talk(args[1:])
+			if err != nil {
+				m.controller.Abort()
+				fmt.Println(err)
+				break
+			}
+			data, err := m.controller.ReadUntilEOI()
 			if err != nil {
 				fmt.Println(err)
 			}
-			data, err := m.input()
+			err = m.controller.Untalk()
 			if err != nil {
 				fmt.Println(err)
 			}
-			m.untalk()
 
 			for _, ch := range data {
 				fmt.Printf("0x%02x ", ch)
@@ -204,426 +458,164 @@ func (m *Monitor) Run() {
 				fmt.Printf("%s", string(ch))
 			}
 			fmt.Printf("\n")
+		case "output":
+			if len(args) < 4 {
+				fmt.Println("output primary_addr secondary_addr text")
+				break
+			}
+			err := m.output(args[1:3], strings.Join(args[3:], " "))
+			if err != nil {
+				fmt.Println(err)
+			}
 		default:
 			fmt.Println("?")
 		}
 	}
 }
 
-func (m *Monitor) open(args []string) error {
-	if len(args) == 0 {
-		return errors.New("usage: open primary_addr [secondary_addr]")
-	}
-
-	var (
-		primary, secondary int64
-		err                error
-	)
+// Print the CPU registers & decode the status register
+func (m *Monitor) registers() {
+	r := m.Drive.Registers()
 
-	primary, err = strconv.ParseInt(args[0], 16, 9)
-	if err != nil {
-		return fmt.Errorf("invalid primary_addr: %w", err)
-	}
-	// Mark the primary address TALK
-	primary = primary + 0x40
-
-	if len(args) == 2 {
-		secondary, err = strconv.ParseInt(args[1], 16, 9)
-		if err != nil {
-			return fmt.Errorf("invalid secondary_addr: %w", err)
+	fmt.Println(r)
+	fmt.Printf("P: $%02x", r.P)
+	for n, name := range "NV-BDIZC" {
+		if name != '-' {
+			fmt.Printf("  %c=%d", name, r.P>>(7-n)&1)
 		}
-		// Mark the secondary address SECOND
-		secondary = secondary + 0x60
-	} else {
-		secondary = 0xff
 	}
-
-	return m.cmd(Byte(primary), Byte(secondary))
+	fmt.Printf("  (in interrupt: %t)\n", r.ISR)
 }
 
-// Send a command (Pull ATN, set primary && secondary address)
-func (m *Monitor) cmd(primary, secondary Byte) error {
-	var ack, ready, busy, accepted bool
-
-	// Pull ATN
-	defer func() {
-		/* Command sequence finished */
-		m.A.Out.ATN = FALSE
-	}()
-	m.A.Reset()
-	m.A.Out.ATN = TRUE
-
-	/* The drive will pull both NDAC & NRFD when acknowledging ATN: the
-	standard says that only NDAC is significant */
-	ack = false
-	for n := 0; n < 500 && !ack; n++ {
-		if m.A.In.NDAC == TRUE {
-			ack = true
-		} else {
-			fmt.Printf("NDAC=%s, NRFD=%s\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-			time.Sleep(1 * time.Millisecond)
+/*
+Set registers from name=value pairs. The drive is paused while they are set,
+so that they all change between the same two instructions.
+*/
+func (m *Monitor) setRegisters(args []string) error {
+	type assignment struct {
+		name  string
+		value Word
+	}
+	var assignments []assignment
+
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid register assignment %q", arg)
 		}
-	}
-	if ack {
-		fmt.Printf("remote acknowledged ATN (NDAC=%s, NRFD=%s)\n",
-			m.A.In.NDAC.ToOnOff(),
-			m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not acknowledge ATN (NDAC=%s, NRFD=%s)\n",
-			m.A.In.NDAC.ToOnOff(),
-			m.A.In.NRFD.ToOnOff())
-	}
-
-	// We have its attention
-	m.A.Out.DIO = primary
-	fmt.Printf("DIO set to 0x%02x (Inverted to 0x%02x)\n", m.A.Out.DIO, ^m.A.Out.DIO)
-
-	/* It should then release NRFD */
-	ready = false
-	for n := 0; n < 500 && !ready; n++ {
-		if m.A.In.NDAC == TRUE && m.A.In.NRFD == FALSE {
-			ready = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
+		v, err := strconv.ParseUint(strings.TrimPrefix(value, "$"), 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid value %q", value)
 		}
+		assignments = append(assignments, assignment{strings.ToLower(name), Word(v)})
 	}
-	if ready {
-		fmt.Printf("remote became ready (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not become ready (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-	}
-
-	/* Data is valid */
-	m.A.Out.DAV = TRUE
 
-	/* Wait for remote to pull NRFD to indicate it is busy */
-	busy = false
-	for n := 0; n < 500 && !busy; n++ {
-		if m.A.In.NRFD == TRUE {
-			busy = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
-	}
-	if busy {
-		fmt.Printf("remote became busy (NRFD=%s)\n", m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not become busy (NRFD=%s)\n", m.A.In.NRFD.ToOnOff())
+	if !m.Drive.Paused() {
+		m.Drive.Pause()
+		defer m.Drive.Resume()
 	}
-
-	/* Wait for remote to release NDAC to indicate it has accepted the byte */
-	accepted = false
-	for n := 0; n < 500 && !accepted; n++ {
-		if m.A.In.NDAC == FALSE {
-			accepted = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
+	for _, a := range assignments {
+		err := m.Drive.SetRegister(a.name, a.value)
+		if err != nil {
+			return err
 		}
 	}
-	if accepted {
-		fmt.Printf("remote accepted byte (NDAC=%s)\n", m.A.In.NDAC.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not accept byte (NDAC=%s)\n", m.A.In.NDAC.ToOnOff())
-	}
-
-	/* First byte sent, data is no longer valid */
-	m.A.Out.DAV = FALSE
-	m.A.Out.DIO = Byte(0)
+	return nil
+}
 
-	idle := false
-	for n := 0; n < 500 && !idle; n++ {
-		if m.A.In.NDAC == TRUE {
-			idle = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
+// Parse an address given in hex or as a label
+func (m *Monitor) address(s string) (Word, error) {
+	if a, ok := m.Symbols().Address(s); ok {
+		return a, nil
 	}
-	if idle {
-		fmt.Printf("remote became idle (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not became idle (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
+	a, err := strconv.ParseUint(strings.TrimPrefix(s, "$"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid addr: %q", s)
 	}
+	return Word(a), nil
+}
 
-	// Send the secondary address if there is one
-	if secondary != 0xff {
-		fmt.Printf("secondary_addr=%x\n", secondary)
-
-		m.A.Out.DIO = secondary
-		fmt.Printf("DIO set to 0x%02x (Inverted to 0x%02x)\n", m.A.Out.DIO, ^m.A.Out.DIO)
-
-		/* Ensure NRFD is high */
-		ready = false
-		for n := 0; n < 500 && !ready; n++ {
-			if m.A.In.NDAC == TRUE && m.A.In.NRFD == FALSE {
-				ready = true
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
-		if ready {
-			fmt.Printf("remote became ready (NDAC=%s, NRFD=%s)\n",
-				m.A.In.NDAC.ToOnOff(),
-				m.A.In.NRFD.ToOnOff())
-		} else {
-			return fmt.Errorf("remote did not become ready (NDAC=%s, NRFD=%s)\n",
-				m.A.In.NDAC.ToOnOff(),
-				m.A.In.NRFD.ToOnOff())
-		}
-
-		/* Data is valid */
-		m.A.Out.DAV = TRUE
-
-		/* Wait for remote to pull NRFD to indicate it is busy */
-		busy = false
-		for n := 0; n < 500 && !busy; n++ {
-			if m.A.In.NRFD == TRUE {
-				busy = true
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
-		if busy {
-			fmt.Printf("remote became busy (NRFD=%s)\n", m.A.In.NRFD.ToOnOff())
-		} else {
-			return fmt.Errorf("remote did not become busy (NRFD=%s)\n", m.A.In.NRFD.ToOnOff())
-		}
-
-		/* Wait for remote to release NDAC to indicate it has accepted the byte */
-		accepted = false
-		for n := 0; n < 500 && !accepted; n++ {
-			if m.A.In.NDAC == FALSE {
-				accepted = true
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
-		if accepted {
-			fmt.Printf("remote accepted byte (NDAC=%s)\n", m.A.In.NDAC.ToOnOff())
-		} else {
-			return fmt.Errorf("remote did not accept byte (NDAC=%s)\n", m.A.In.NDAC.ToOnOff())
-		}
-
-		/* Second byte sent, data is no longer valid */
-		m.A.Out.DAV = FALSE
-		m.A.Out.DIO = Byte(0xff)
-
-		idle := false
-		for n := 0; n < 500 && !idle; n++ {
-			if m.A.In.NDAC == TRUE {
-				idle = true
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
-		if idle {
-			fmt.Printf("remote became idle (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-		} else {
-			return fmt.Errorf("remote did not became idle (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
+// Disassemble count instructions from addr, with a line for each label
+func (m *Monitor) disassemble(addr Word, count int) {
+	symbols := m.Symbols()
+	for n := 0; n < count; n++ {
+		if label, ok := symbols.Name(addr); ok {
+			fmt.Printf("%s:\n", label)
 		}
+		text, size := Disassemble(m.Drive.Peek, addr, symbols)
+		fmt.Println(text)
+		addr += Word(size)
 	}
-
-	/* Command sequence finished */
-	m.A.Out.ATN = FALSE
-	m.A.Out.NRFD = TRUE
-	m.A.Out.NDAC = TRUE
-
-	return nil
+	m.disNext, m.disPC, m.disSet = addr, m.Drive.PC(), true
 }
 
-// Input from the bus
-func (m *Monitor) input() ([]Byte, error) {
-	var data []Byte
-
-	// Max. data is 80 characters, or until we read CR
-	for len(data) < 80 {
-		fmt.Printf("portA=0x%02x, portAdir=0x%02x\n", m.BVIA.PeekRegister(PORT_A), m.BVIA.PeekRegister(PORT_A_DIR))
-		ch, err := m.readByte()
-		if err != nil {
-			return data, fmt.Errorf("failed to read from bus: %w", err)
-		}
-		data = append(data, ch)
-
-		// Did we read CR?
-		if ch == 0x13 {
-			break
-		}
+// Print where the drive is whenever it stops itself
+func (m *Monitor) reportStops() {
+	for s := range m.Drive.Stops() {
+		fmt.Printf("\n%s\n%s\n> ", s, m.Drive.Registers())
 	}
-	fmt.Printf("read %d characters\n", len(data))
-
-	return data, nil
 }
 
-// Reads a single byte from the bus
-func (m *Monitor) readByte() (Byte, error) {
-	var (
-		data            Byte
-		valid, finished bool
-	)
-
-	// We are ready for data
-	defer func() {
-		m.A.Out.NRFD = TRUE
-		//m.A.Out.NDAC = FALSE
-	}()
-	m.A.Out.DAV = FLOATING
-	m.A.Out.NRFD = FALSE
-	m.A.Out.NDAC = TRUE
-
-	fmt.Println("Waiting for data...")
-
-	// Wait for the remote end to assert DAV
-	valid = false
-	for n := 0; n < 500 && !valid; n++ {
-		if m.A.In.DAV == TRUE {
-			valid = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
+// Parse a primary address & an optional secondary address, in hex
+func busAddress(args []string) (int, int, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return 0, 0, errors.New("usage: primary_addr [secondary_addr]")
 	}
-	if valid {
-		fmt.Printf("data valid (DAV=%s)\n", m.A.In.DAV.ToOnOff())
-	} else {
-		return data, fmt.Errorf("no valid data (DAV=%s)\n", m.A.In.DAV.ToOnOff())
-	}
-	m.A.Out.NRFD = TRUE
-	time.Sleep(1 * time.Millisecond)
-
-	// Read DIO
-	data = m.A.In.DIO
-	fmt.Printf("DIO set to 0x%02x (Inverted from 0x%02x)\n", m.A.In.DIO, ^m.A.In.DIO)
 
-	// Was EOI asserted?
-	if m.A.In.EOI == TRUE {
-		fmt.Println("EOI asserted")
-		data = 0x13 // Force data to CR
+	primary, err := strconv.ParseUint(args[0], 16, 5)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid primary_addr: %w", err)
 	}
-
-	// Pull NDAC to indicate we have read the byte
-	m.A.Out.NDAC = FALSE
-
-	// Wait for the remote to raise DAV
-	finished = false
-	for n := 0; n < 500 && !finished; n++ {
-		if m.A.In.DAV == FALSE {
-			finished = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
+	if len(args) == 1 {
+		return int(primary), NO_SECONDARY, nil
 	}
-	if finished {
-		fmt.Printf("read accepted (DAV=%s)\n", m.A.In.DAV.ToOnOff())
-	} else {
-		return data, fmt.Errorf("read not accepted (DAV=%s)\n", m.A.In.DAV.ToOnOff())
+	secondary, err := strconv.ParseUint(args[1], 16, 5)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid secondary_addr: %w", err)
 	}
-
-	// We are not ready for the next byte
-	m.A.Out.NDAC = TRUE
-	m.A.Out.NRFD = TRUE
-
-	return data, nil
+	return int(primary), int(secondary), nil
 }
 
-func (m *Monitor) untalk() error {
-	var ack, ready, busy, accepted bool
-
-	// Pull ATN
-	defer func() {
-		/* Command sequence finished */
-		m.A.Out.ATN = FALSE
-	}()
-	m.A.Reset()
-	m.A.Out.ATN = TRUE
+/*
+A context for next & finish, cancelled by Ctrl-C. If the drive isn't running
+they execute in the monitor, & a routine that never returns would otherwise
+hang it.
+*/
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
 
-	/* The drive will pull both NDAC & NRFD when acknowledging ATN: the
-	standard says that only NDAC is significant */
-	ack = false
-	for n := 0; n < 500 && !ack; n++ {
-		if m.A.In.NDAC == TRUE {
-			ack = true
-		} else {
-			fmt.Printf("NDAC=%s, NRFD=%s\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-			time.Sleep(1 * time.Millisecond)
-		}
-	}
-	if ack {
-		fmt.Printf("remote acknowledged ATN (NDAC=%s, NRFD=%s)\n",
-			m.A.In.NDAC.ToOnOff(),
-			m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not acknowledge ATN (NDAC=%s, NRFD=%s)\n",
-			m.A.In.NDAC.ToOnOff(),
-			m.A.In.NRFD.ToOnOff())
+// Tell a device to talk, on a channel if one is given
+func (m *Monitor) talk(args []string) error {
+	primary, secondary, err := busAddress(args)
+	if err != nil {
+		return err
 	}
 
-	// We have its attention; send UNTALK
-	m.A.Out.DIO = 0x5f
-	fmt.Printf("DIO set to 0x%02x (Inverted to 0x%02x)\n", m.A.Out.DIO, ^m.A.Out.DIO)
-
-	/* It should then release NRFD */
-	ready = false
-	for n := 0; n < 500 && !ready; n++ {
-		if m.A.In.NDAC == TRUE && m.A.In.NRFD == FALSE {
-			ready = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
-	}
-	if ready {
-		fmt.Printf("remote became ready (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not become ready (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
+	err = m.controller.Talk(primary)
+	if err == nil && secondary != NO_SECONDARY {
+		err = m.controller.Second(secondary)
 	}
+	return err
+}
 
-	/* Data is valid */
-	m.A.Out.DAV = TRUE
-
-	/* Wait for remote to pull NRFD to indicate it is busy */
-	busy = false
-	for n := 0; n < 500 && !busy; n++ {
-		if m.A.In.NRFD == TRUE {
-			busy = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
-	}
-	if busy {
-		fmt.Printf("remote became busy (NRFD=%s)\n", m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not become busy (NRFD=%s)\n", m.A.In.NRFD.ToOnOff())
+// Send text to a channel of a device, ending with EOI
+func (m *Monitor) output(args []string, text string) error {
+	primary, secondary, err := busAddress(args)
+	if err != nil {
+		return err
 	}
 
-	/* Wait for remote to release NDAC to indicate it has accepted the byte */
-	accepted = false
-	for n := 0; n < 500 && !accepted; n++ {
-		if m.A.In.NDAC == FALSE {
-			accepted = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
+	err = m.controller.Listen(primary)
+	if err == nil {
+		err = m.controller.Second(secondary)
 	}
-	if accepted {
-		fmt.Printf("remote accepted byte (NDAC=%s)\n", m.A.In.NDAC.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not accept byte (NDAC=%s)\n", m.A.In.NDAC.ToOnOff())
+	if err == nil {
+		err = m.controller.SendBytes([]Byte(text), true)
 	}
-
-	/* First byte sent, data is no longer valid */
-	m.A.Out.DAV = FALSE
-	m.A.Out.DIO = Byte(0)
-
-	idle := false
-	for n := 0; n < 500 && !idle; n++ {
-		if m.A.In.NDAC == TRUE {
-			idle = true
-		} else {
-			time.Sleep(1 * time.Millisecond)
-		}
-	}
-	if idle {
-		fmt.Printf("remote became idle (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
-	} else {
-		return fmt.Errorf("remote did not became idle (NDAC=%s, NRFD=%s)\n", m.A.In.NDAC.ToOnOff(), m.A.In.NRFD.ToOnOff())
+	if err != nil {
+		m.controller.Abort()
+		return err
 	}
-
-	return nil
+	return m.controller.Unlisten()
 }
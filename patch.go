@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+Patch replaces the bytes at Address with Data, but only if the ROM currently
+contains Expect at that address. Expect & Data must be the same length.
+*/
+type Patch struct {
+	Address Word
+	Expect  []Byte
+	Data    []Byte
+}
+
+func (p Patch) String() string {
+	return fmt.Sprintf("$%04x: %s = %s", p.Address, hexBytes(p.Expect), hexBytes(p.Data))
+}
+
+/*
+LoadPatchFile reads a list of patches from a file. Each line holds an address,
+the original bytes and the replacement bytes, all in hex:
+
+	# Remove a delay loop
+	$eaa6: d0 fc = ea ea
+
+Blank lines and anything following a # are ignored.
+*/
+func LoadPatchFile(filename string) ([]Patch, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patches []Patch
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if n := strings.IndexByte(text, '#'); n >= 0 {
+			text = text[:n]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		p, err := parsePatch(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		patches = append(patches, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return patches, nil
+}
+
+func parsePatch(text string) (Patch, error) {
+	var p Patch
+
+	addr, rest, ok := strings.Cut(text, ":")
+	if !ok {
+		return p, fmt.Errorf("missing ':' after address")
+	}
+	a, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(addr), "$"), 16, 16)
+	if err != nil {
+		return p, fmt.Errorf("invalid address %q", addr)
+	}
+	p.Address = Word(a)
+
+	expect, data, ok := strings.Cut(rest, "=")
+	if !ok {
+		return p, fmt.Errorf("missing '=' between original & replacement bytes")
+	}
+	if p.Expect, err = parseHexBytes(expect); err != nil {
+		return p, err
+	}
+	if p.Data, err = parseHexBytes(data); err != nil {
+		return p, err
+	}
+
+	if len(p.Data) == 0 {
+		return p, fmt.Errorf("no replacement bytes")
+	}
+	if len(p.Expect) != len(p.Data) {
+		return p, fmt.Errorf("%d original bytes but %d replacement bytes", len(p.Expect), len(p.Data))
+	}
+
+	return p, nil
+}
+
+func parseHexBytes(s string) ([]Byte, error) {
+	var data []Byte
+
+	for _, field := range strings.Fields(s) {
+		b, err := strconv.ParseUint(strings.TrimPrefix(field, "$"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid byte %q", field)
+		}
+		data = append(data, Byte(b))
+	}
+	return data, nil
+}
+
+func hexBytes(data []Byte) string {
+	s := make([]string, len(data))
+	for n, b := range data {
+		s[n] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		text string
+		want Patch
+		err  string
+	}{
+		{"$eaa6: d0 fc = ea ea", Patch{0xeaa6, []Byte{0xd0, 0xfc}, []Byte{0xea, 0xea}}, ""},
+		{"c000:$01=$02", Patch{0xc000, []Byte{0x01}, []Byte{0x02}}, ""},
+		{"$eaa6 d0 fc = ea ea", Patch{}, "missing ':'"},
+		{"$10000: 00 = 01", Patch{}, "invalid address"},
+		{"$eaa6: d0 fc ea ea", Patch{}, "missing '='"},
+		{"$eaa6: d0 = xx", Patch{}, "invalid byte"},
+		{"$eaa6: d0 = 100", Patch{}, "invalid byte"},
+		{"$eaa6: =", Patch{}, "no replacement bytes"},
+		{"$eaa6: d0 fc = ea", Patch{}, "2 original bytes but 1 replacement bytes"},
+	}
+
+	for _, tt := range tests {
+		p, err := parsePatch(tt.text)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.text, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%q: got %s, want %s", tt.text, p, tt.want)
+		}
+	}
+}
+
+func TestLoadPatchFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.patch")
+	err := os.WriteFile(filename, []byte(`# Remove a delay loop
+$eaa6: d0 fc = ea ea
+
+$c000: 01 = 02 # Trailing comment
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patches, err := LoadPatchFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 2 || patches[0].Address != 0xeaa6 || patches[1].Address != 0xc000 {
+		t.Errorf("got %v", patches)
+	}
+
+	// Errors give the line number
+	err = os.WriteFile(filename, []byte("$eaa6: d0 fc = ea ea\n$eaa6: d0\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadPatchFile(filename)
+	if err == nil || !strings.Contains(err.Error(), "test.patch:2:") {
+		t.Errorf("got error %v, want one for line 2", err)
+	}
+}
+
+func TestApplyPatches(t *testing.T) {
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+
+	lo, hi := Word(0xc000), Word(0xe000)
+	loByte, hiByte := c.bus.Peek(lo), c.bus.Peek(hi)
+
+	err := c.ApplyPatches([]Patch{
+		{lo, []Byte{loByte}, []Byte{^loByte}},
+		{hi, []Byte{hiByte}, []Byte{^hiByte}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.bus.Peek(lo) != ^loByte || c.bus.Peek(hi) != ^hiByte {
+		t.Error("patches were not applied")
+	}
+
+	// Later patches can rely on earlier ones
+	err = c.ApplyPatches([]Patch{
+		{lo, []Byte{^loByte}, []Byte{0x12}},
+		{lo, []Byte{0x12}, []Byte{0x34}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.bus.Peek(lo); got != 0x34 {
+		t.Errorf("$%04x = $%02x, want $34", lo, got)
+	}
+}
+
+// A patch that doesn't match leaves the ROMs untouched
+func TestApplyPatchesMismatch(t *testing.T) {
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+
+	lo, hi := Word(0xc000), Word(0xe000)
+	loByte, hiByte := c.bus.Peek(lo), c.bus.Peek(hi)
+
+	for _, patches := range [][]Patch{
+		{
+			{lo, []Byte{loByte}, []Byte{^loByte}},
+			{hi, []Byte{^hiByte}, []Byte{0x00}},
+		},
+		{
+			{lo, []Byte{loByte}, []Byte{^loByte}},
+			{0x1000, []Byte{0x00}, []Byte{0x01}},
+		},
+		{
+			{lo, []Byte{loByte}, []Byte{^loByte}},
+			{0xffff, []Byte{0x00, 0x00}, []Byte{0x01, 0x01}},
+		},
+	} {
+		err := c.ApplyPatches(patches)
+		if err == nil {
+			t.Errorf("%v: no error", patches)
+		}
+		if c.bus.Peek(lo) != loByte || c.bus.Peek(hi) != hiByte {
+			t.Fatalf("%v: ROM changed by a failed set of patches", patches)
+		}
+	}
+}
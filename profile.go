@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	PROFILE_HOTTEST = 20  // Addresses & routines listed in the report
+	HITMAP_WIDTH    = 64  // Characters in each row of a hit map
+	HITMAP_CHARS    = 512 // Characters in the hit map of each ROM
+	TOP_LEVEL_NAME  = "(top level)"
+)
+
+/*
+Profiler counts how many times each address is executed & how many cycles are
+spent in each routine. Routines are tracked with a shadow call stack: JSR &
+interrupts start a routine, which ends when the stack pointer rises above
+where it was on entry. This copes with code that discards return addresses
+rather than returning with RTS.
+*/
+type Profiler struct {
+	executions [0x10000]uint64
+	cycles     [0x10000]uint64
+	routines   map[Word]*routine
+	topLevel   routine
+	stack      []frame
+	total      uint64 // Cycles, including entering interrupt handlers
+}
+
+type routine struct {
+	calls  uint64
+	cycles uint64
+}
+
+type frame struct {
+	routine *routine
+	s       Byte // Stack pointer on entry
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		routines: make(map[Word]*routine),
+	}
+}
+
+// Count an instruction at pc; next is the address of the following instruction
+func (p *Profiler) instruction(pc Word, opcode Byte, cycles int, next Word, s Byte) {
+	p.executions[pc]++
+	p.cycles[pc] += uint64(cycles)
+	p.total += uint64(cycles)
+	p.current().cycles += uint64(cycles)
+
+	p.unwind(s)
+	if opcode == OPCODE_JSR {
+		p.call(next, s)
+	}
+}
+
+// Count an interrupt that entered the handler at pc
+func (p *Profiler) interrupt(pc Word, cycles int, s Byte) {
+	p.call(pc, s)
+	p.current().cycles += uint64(cycles)
+	p.total += uint64(cycles)
+}
+
+func (p *Profiler) call(address Word, s Byte) {
+	r, ok := p.routines[address]
+	if !ok {
+		r = &routine{}
+		p.routines[address] = r
+	}
+	r.calls++
+	p.stack = append(p.stack, frame{r, s})
+}
+
+// Leave any routines whose stack frames have been removed
+func (p *Profiler) unwind(s Byte) {
+	for len(p.stack) > 0 && p.stack[len(p.stack)-1].s < s {
+		p.stack = p.stack[:len(p.stack)-1]
+	}
+}
+
+func (p *Profiler) current() *routine {
+	if len(p.stack) == 0 {
+		return &p.topLevel
+	}
+	return p.stack[len(p.stack)-1].routine
+}
+
+// ProfileReport summarises the profile for people & programs
+type ProfileReport struct {
+	Cycles       uint64           `json:"cycles"`
+	Instructions uint64           `json:"instructions"`
+	ROMs         []ROMCoverage    `json:"roms"`
+	Hottest      []AddressProfile `json:"hottest"`
+	Routines     []RoutineProfile `json:"routines"`
+}
+
+// ROMCoverage shows which parts of a ROM were executed
+type ROMCoverage struct {
+	Start      Word     `json:"start"`
+	End        Word     `json:"end"`
+	Executed   int      `json:"executed_bytes"`
+	Size       int      `json:"size"`
+	HitMap     []string `json:"hit_map"`
+	Unexecuted []Range  `json:"unexecuted"`
+}
+
+type Range struct {
+	Start Word `json:"start"`
+	End   Word `json:"end"`
+}
+
+type AddressProfile struct {
+	Address    Word   `json:"address"`
+	Label      string `json:"label,omitempty"`
+	Executions uint64 `json:"executions"`
+	Cycles     uint64 `json:"cycles"`
+}
+
+type RoutineProfile struct {
+	Address Word   `json:"address"`
+	Label   string `json:"label,omitempty"`
+	Calls   uint64 `json:"calls"`
+	Cycles  uint64 `json:"cycles"` // Cycles spent in the routine itself, not its callees
+}
+
+// Report builds a report on the profile, with labels from symbols if given
+func (p *Profiler) Report(roms []*ROM, symbols *Symbols) *ProfileReport {
+	r := &ProfileReport{Cycles: p.total}
+
+	var hottest []AddressProfile
+	for addr, n := range p.executions {
+		if n == 0 {
+			continue
+		}
+		r.Instructions += n
+
+		label, _ := symbols.Name(Word(addr))
+		hottest = append(hottest, AddressProfile{Word(addr), label, n, p.cycles[addr]})
+	}
+	sort.SliceStable(hottest, func(i, j int) bool {
+		return hottest[i].Cycles > hottest[j].Cycles
+	})
+	if len(hottest) > PROFILE_HOTTEST {
+		hottest = hottest[:PROFILE_HOTTEST]
+	}
+	r.Hottest = hottest
+
+	r.Routines = append(r.Routines, RoutineProfile{Label: TOP_LEVEL_NAME, Cycles: p.topLevel.cycles})
+	for addr, rt := range p.routines {
+		label, _ := symbols.Name(addr)
+		r.Routines = append(r.Routines, RoutineProfile{addr, label, rt.calls, rt.cycles})
+	}
+	sort.Slice(r.Routines, func(i, j int) bool {
+		if r.Routines[i].Cycles != r.Routines[j].Cycles {
+			return r.Routines[i].Cycles > r.Routines[j].Cycles
+		}
+		return r.Routines[i].Address < r.Routines[j].Address
+	})
+
+	for _, rom := range roms {
+		r.ROMs = append(r.ROMs, p.coverage(rom))
+	}
+
+	return r
+}
+
+// Work out which bytes of a ROM were executed, as opcodes or operands
+func (p *Profiler) coverage(rom *ROM) ROMCoverage {
+	executed := make([]bool, rom.Size)
+	for n := 0; n < int(rom.Size); n++ {
+		if p.executions[rom.Base+Word(n)] == 0 {
+			continue
+		}
+		size := 1
+		if ins := instructions[rom.Peek(rom.Base+Word(n))]; ins.mnemonic != "" {
+			size = modeSize[ins.mode]
+		}
+		for i := n; i < n+size && i < len(executed); i++ {
+			executed[i] = true
+		}
+	}
+
+	c := ROMCoverage{
+		Start: rom.Base,
+		End:   rom.Base + rom.Size - 1,
+		Size:  int(rom.Size),
+	}
+
+	// Each character of the hit map covers a block of bytes
+	block := int(rom.Size) / HITMAP_CHARS
+	var row strings.Builder
+	for n := 0; n < len(executed); n += block {
+		ch := byte('.')
+		for _, e := range executed[n : n+block] {
+			if e {
+				ch = '#'
+				break
+			}
+		}
+		row.WriteByte(ch)
+		if row.Len() == HITMAP_WIDTH {
+			c.HitMap = append(c.HitMap, row.String())
+			row.Reset()
+		}
+	}
+
+	for n := 0; n < len(executed); n++ {
+		if executed[n] {
+			c.Executed++
+			continue
+		}
+		start := n
+		for n+1 < len(executed) && !executed[n+1] {
+			n++
+		}
+		c.Unexecuted = append(c.Unexecuted, Range{rom.Base + Word(start), rom.Base + Word(n)})
+	}
+
+	return c
+}
+
+func (r *ProfileReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Profile: %d cycles, %d instructions\n", r.Cycles, r.Instructions)
+
+	for _, c := range r.ROMs {
+		fmt.Fprintf(w, "\nROM $%04x-$%04x: %d of %d bytes executed (%.1f%%)\n",
+			c.Start, c.End, c.Executed, c.Size, percent(uint64(c.Executed), uint64(c.Size)))
+
+		block := c.Size / HITMAP_CHARS
+		for n, row := range c.HitMap {
+			fmt.Fprintf(w, "$%04x %s\n", c.Start+Word(n*HITMAP_WIDTH*block), row)
+		}
+
+		fmt.Fprintln(w, "Never executed:")
+		for _, u := range c.Unexecuted {
+			fmt.Fprintf(w, "  $%04x-$%04x (%d bytes)\n", u.Start, u.End, int(u.End-u.Start)+1)
+		}
+	}
+
+	fmt.Fprintln(w, "\nHottest addresses")
+	for _, a := range r.Hottest {
+		fmt.Fprintf(w, "  $%04x %-16s %10d executions %12d cycles (%.1f%%)\n",
+			a.Address, a.Label, a.Executions, a.Cycles, percent(a.Cycles, r.Cycles))
+	}
+
+	fmt.Fprintln(w, "\nRoutines by cycles")
+	for n, rt := range r.Routines {
+		if n == PROFILE_HOTTEST {
+			break
+		}
+		addr := fmt.Sprintf("$%04x", rt.Address)
+		if rt.Label == TOP_LEVEL_NAME {
+			addr = "     "
+		}
+		fmt.Fprintf(w, "  %s %-16s %10d calls %12d cycles (%.1f%%)\n",
+			addr, rt.Label, rt.Calls, rt.Cycles, percent(rt.Cycles, r.Cycles))
+	}
+}
+
+func (r *ProfileReport) WriteJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(r)
+}
+
+// WriteFile writes the report as JSON if the filename ends in .json, else text
+func (r *ProfileReport) WriteFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(filename, ".json") {
+		err = r.WriteJSON(f)
+	} else {
+		r.WriteText(f)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// EnableProfiler starts profiling execution
+func (c *CBM2031) EnableProfiler() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.profiler = NewProfiler()
+}
+
+// ProfileReport reports on the profile so far
+func (c *CBM2031) ProfileReport(symbols *Symbols) (*ProfileReport, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.profiler == nil {
+		return nil, errors.New("the profiler is not enabled")
+	}
+	return c.profiler.Report([]*ROM{c.loRom, c.hiRom}, symbols), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestProfileRoutines(t *testing.T) {
+	c := newSubroutineDrive()
+	c.EnableProfiler()
+
+	err := c.Step(5) // JSR; INX; INX; RTS; NOP
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.ProfileReport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Instructions != 5 || r.Cycles != 6+2+2+6+2 {
+		t.Errorf("%d instructions, %d cycles; want 5 & 18", r.Instructions, r.Cycles)
+	}
+
+	routines := make(map[string]RoutineProfile)
+	for _, rt := range r.Routines {
+		routines[rt.Label] = rt
+		if rt.Address == 0x310 {
+			routines["sub"] = rt
+		}
+	}
+	if sub := routines["sub"]; sub.Calls != 1 || sub.Cycles != 2+2+6 {
+		t.Errorf("subroutine: %d calls, %d cycles; want 1 & 10", sub.Calls, sub.Cycles)
+	}
+	if top := routines[TOP_LEVEL_NAME]; top.Cycles != 6+2 {
+		t.Errorf("top level: %d cycles, want 8", top.Cycles)
+	}
+}
+
+func TestProfileCoverage(t *testing.T) {
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+	c.EnableProfiler()
+
+	err := c.Step(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.ProfileReport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.ROMs) != 2 {
+		t.Fatalf("%d ROMs in the report, want 2", len(r.ROMs))
+	}
+
+	for _, rom := range r.ROMs {
+		unexecuted := 0
+		for _, u := range rom.Unexecuted {
+			unexecuted += int(u.End-u.Start) + 1
+		}
+		if rom.Executed+unexecuted != rom.Size {
+			t.Errorf("ROM $%04x: %d executed + %d unexecuted bytes != %d", rom.Start, rom.Executed, unexecuted, rom.Size)
+		}
+		if len(rom.HitMap) != HITMAP_CHARS/HITMAP_WIDTH {
+			t.Errorf("ROM $%04x: hit map has %d rows", rom.Start, len(rom.HitMap))
+		}
+	}
+	if r.ROMs[1].Executed == 0 {
+		t.Error("no code executed in the $e000 ROM after reset")
+	}
+
+	var buf bytes.Buffer
+	err = r.WriteJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ProfileReport
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Instructions != r.Instructions {
+		t.Errorf("JSON has %d instructions, want %d", decoded.Instructions, r.Instructions)
+	}
+}
@@ -31,6 +31,10 @@ func (r *RAM) Read(address Word) Byte {
 	return r.mem[address-r.Base]
 }
 
+func (r *RAM) Peek(address Word) Byte {
+	return r.Read(address)
+}
+
 func (r *RAM) Write(address Word, data Byte) {
 	r.mem[address-r.Base] = data
 }
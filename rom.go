@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 )
 
@@ -35,6 +36,10 @@ func (r *ROM) Read(address Word) Byte {
 	return r.mem[address-r.Base]
 }
 
+func (r *ROM) Peek(address Word) Byte {
+	return r.Read(address)
+}
+
 func (r *ROM) Write(Word, Byte) {
 	// ROM
 }
@@ -66,3 +71,38 @@ func (r *ROM) PatchVector(vector Word, patch []Byte) {
 		r.mem[(addr+Word(n))-r.Base] = b
 	}
 }
+
+// Copy returns a ROM with a copy of the contents
+func (r *ROM) Copy() *ROM {
+	c := *r
+	c.mem = append([]Byte(nil), r.mem...)
+	return &c
+}
+
+// Contains returns true if the address falls within the ROM
+func (r *ROM) Contains(address Word) bool {
+	return address >= r.Base && address <= r.Base+(r.Size-1)
+}
+
+// Patch applies the patch, if the ROM contents match what the patch expects
+func (r *ROM) Patch(p Patch) error {
+	end := p.Address + Word(len(p.Data)-1)
+	if !r.Contains(p.Address) || !r.Contains(end) || end < p.Address {
+		return fmt.Errorf("patch $%04x-$%04x is outside ROM $%04x-$%04x",
+			p.Address, end, r.Base, r.Base+(r.Size-1))
+	}
+
+	// Verify before modifying anything
+	for n, b := range p.Expect {
+		addr := p.Address + Word(n)
+		if r.Read(addr) != b {
+			return fmt.Errorf("patch $%04x: expected $%02x at $%04x, found $%02x",
+				p.Address, b, addr, r.Read(addr))
+		}
+	}
+
+	for n, b := range p.Data {
+		r.mem[(p.Address+Word(n))-r.Base] = b
+	}
+	return nil
+}
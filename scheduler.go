@@ -0,0 +1,107 @@
+package main
+
+import "math"
+
+// NO_EVENT is returned by IdleCycles when a device has nothing scheduled
+const NO_EVENT = math.MaxInt32
+
+// Clocked devices can be clocked in bulk over cycles where nothing happens
+type Clocked interface {
+	Advance(cycles int) // Clock the device for a number of cycles
+	IdleCycles() int    // Number of cycles before the next event
+}
+
+/*
+Scheduler keeps Clocked devices in step with the CPU. Rather than clocking
+every device on every cycle, each device is only brought up to date when its
+next event is due, or when something is about to access it.
+*/
+type Scheduler struct {
+	now    uint64 // Current cycle
+	events []*event
+}
+
+type event struct {
+	device Clocked
+	synced uint64 // Cycle the device has been clocked up to
+	due    uint64 // Cycle of the device's next event
+}
+
+func (s *Scheduler) Add(device Clocked) {
+	s.events = append(s.events, &event{
+		device: device,
+		synced: s.now,
+		due:    s.now,
+	})
+}
+
+// Now returns the current cycle
+func (s *Scheduler) Now() uint64 {
+	return s.now
+}
+
+// Advance moves time forward & clocks any devices that have an event due
+func (s *Scheduler) Advance(cycles int) {
+	s.now += uint64(cycles)
+
+	for _, e := range s.events {
+		if s.now >= e.due {
+			s.sync(e)
+		}
+	}
+}
+
+/*
+Touch brings a device up to date before it is accessed. The access may change
+when the next event is due, so it is recalculated on the next Advance.
+*/
+func (s *Scheduler) Touch(device Clocked) {
+	for _, e := range s.events {
+		if e.device == device {
+			s.sync(e)
+			e.due = s.now
+		}
+	}
+}
+
+/*
+Restart moves time to now, e.g. after restoring a snapshot. The devices are
+assumed to already be in step with the new time.
+*/
+func (s *Scheduler) Restart(now uint64) {
+	s.now = now
+	for _, e := range s.events {
+		e.synced = now
+		e.due = now
+	}
+}
+
+func (s *Scheduler) sync(e *event) {
+	e.device.Advance(int(s.now - e.synced))
+	e.synced = s.now
+	e.due = s.now + uint64(e.device.IdleCycles()) + 1
+}
+
+/*
+ScheduledDevice wraps a Clocked device on the bus so that it is brought up to
+date whenever the CPU accesses it
+*/
+type ScheduledDevice struct {
+	Device
+	Scheduler *Scheduler
+}
+
+func (d ScheduledDevice) Read(address Word) Byte {
+	d.Scheduler.Touch(d.Device.(Clocked))
+	return d.Device.Read(address)
+}
+
+func (d ScheduledDevice) Peek(address Word) Byte {
+	d.Scheduler.Touch(d.Device.(Clocked))
+	return d.Device.Peek(address)
+}
+
+func (d ScheduledDevice) Write(address Word, data Byte) {
+	d.Scheduler.Touch(d.Device.(Clocked))
+	d.Device.Write(address, data)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	SNAPSHOT_MAGIC   = "CBM2031SNAP" // Identifies a snapshot file
+	SNAPSHOT_VERSION = 3             // Incremented when the format changes
+)
+
+/*
+Snapshot is the complete state of a drive. The drive mechanics are not
+emulated, so there is no media or head position to save; everything the DOS
+can observe is in the CPU, RAM & VIAs, & the lines on the bus.
+
+The other participants on the bus aren't part of the drive, so restoring a
+snapshot gives the drive the lines as they were but can't make the host drive
+them. They are replaced by the live bus when it is next synced.
+*/
+type Snapshot struct {
+	Version int
+	Cycles  uint64
+	ROM     string // Hash of the ROMs, which differ if they were patched
+
+	CPU  CPUState
+	RAM  []Byte
+	VIA1 VIAState
+	VIA2 VIAState
+	Held bool    // Held in reset by IFC
+	Bus  IEEE488 // Lines on the bus, as last seen by the drive
+}
+
+// ErrROMMismatch is returned when restoring a snapshot taken with other ROMs
+var ErrROMMismatch = errors.New("snapshot was taken with different ROMs or patches")
+
+type CPUState struct {
+	A, X, Y, S, P Byte
+	PC            Word
+	ISR           bool // Handling an interrupt, which masks further interrupts
+}
+
+func (s CPUState) String() string {
+	return fmt.Sprintf("PC:$%04x A:%02x X:%02x Y:%02x S:%02x P:%s", s.PC, s.A, s.X, s.Y, s.S, flags(s.P))
+}
+
+// Snapshot captures the state of the drive between instructions
+func (c *CBM2031) Snapshot() *Snapshot {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.snapshot()
+}
+
+func (c *CBM2031) snapshot() *Snapshot {
+	// Bring the VIAs up to date
+	c.scheduler.Touch(c.via1)
+	c.scheduler.Touch(c.via2)
+
+	s := &Snapshot{
+		Version: SNAPSHOT_VERSION,
+		Cycles:  c.Cycles(),
+		ROM:     c.romHash,
+		CPU:     c.registers(),
+		RAM:     make([]Byte, c.ram.Size),
+		VIA1:    c.via1.State(),
+		VIA2:    c.via2.State(),
+		Held:    c.held,
+		Bus:     c.lines,
+	}
+	for n := range s.RAM {
+		s.RAM[n] = c.ram.Peek(c.ram.Base + Word(n))
+	}
+	return s
+}
+
+// Restore returns the drive to the state in a snapshot
+func (c *CBM2031) Restore(s *Snapshot) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.restore(s)
+	if err != nil {
+		return err
+	}
+
+	// The history leading up to the snapshot is unknown
+	c.restartHistory()
+	return nil
+}
+
+func (c *CBM2031) restore(s *Snapshot) error {
+	if s.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	if len(s.RAM) != int(c.ram.Size) {
+		return fmt.Errorf("snapshot has %d bytes of RAM, drive has %d", len(s.RAM), c.ram.Size)
+	}
+	if s.ROM != c.romHash {
+		return ErrROMMismatch
+	}
+
+	c.newCPU(s.CPU.ISR)
+	c.cpu.Registers.A.Set(s.CPU.A)
+	c.cpu.Registers.X.Set(s.CPU.X)
+	c.cpu.Registers.Y.Set(s.CPU.Y)
+	c.cpu.Registers.S.Set(s.CPU.S)
+	c.cpu.Registers.P.SetByte(s.CPU.P)
+	c.cpu.PC.Set(s.CPU.PC)
+
+	for n, b := range s.RAM {
+		c.ram.Write(c.ram.Base+Word(n), b)
+	}
+	c.via1.SetState(s.VIA1)
+	c.via2.SetState(s.VIA2)
+	c.held = s.Held
+	c.lines = s.Bus
+	c.CreateConnector().Write(s.Bus)
+	c.calls = nil // Not known until routines return
+	c.scheduler.Restart(s.Cycles)
+
+	return nil
+}
+
+// Hash the contents of the ROMs
+func (c *CBM2031) hashROMs() string {
+	h := sha256.New()
+	for _, rom := range []*ROM{c.loRom, c.hiRom} {
+		data := make([]byte, len(rom.mem))
+		for n, b := range rom.mem {
+			data[n] = byte(b)
+		}
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// SaveSnapshot writes the state of the drive to w
+func (c *CBM2031) SaveSnapshot(w io.Writer) error {
+	_, err := io.WriteString(w, SNAPSHOT_MAGIC)
+	if err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(c.Snapshot())
+}
+
+// LoadSnapshot restores the state of the drive from r
+func (c *CBM2031) LoadSnapshot(r io.Reader) error {
+	magic := make([]byte, len(SNAPSHOT_MAGIC))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || string(magic) != SNAPSHOT_MAGIC {
+		return fmt.Errorf("not a snapshot")
+	}
+
+	var s Snapshot
+	err = gob.NewDecoder(r).Decode(&s)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return c.Restore(&s)
+}
+
+func (c *CBM2031) SaveSnapshotFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	err = c.SaveSnapshot(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *CBM2031) LoadSnapshotFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = c.LoadSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
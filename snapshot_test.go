@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+
+	// Boot far enough for the DOS to be running its job loop under IRQ
+	err := c.Step(20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = c.SaveSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Step(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := c.Snapshot()
+
+	// Execution continues identically in a new drive restored from the snapshot
+	r := mustNewCBM2031(DEFAULT_DEVICE)
+	err = r.LoadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Step(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.Snapshot()
+
+	if got.Cycles != want.Cycles {
+		t.Errorf("cycles = %d, want %d", got.Cycles, want.Cycles)
+	}
+	if got.CPU != want.CPU {
+		t.Errorf("CPU = %+v, want %+v", got.CPU, want.CPU)
+	}
+	if !reflect.DeepEqual(got.RAM, want.RAM) {
+		t.Error("RAM differs")
+	}
+	if !reflect.DeepEqual(got.VIA1, want.VIA1) {
+		t.Errorf("VIA1 = %+v, want %+v", got.VIA1, want.VIA1)
+	}
+	if !reflect.DeepEqual(got.VIA2, want.VIA2) {
+		t.Errorf("VIA2 = %+v, want %+v", got.VIA2, want.VIA2)
+	}
+}
+
+func TestSnapshotISR(t *testing.T) {
+	for _, isr := range []bool{true, false} {
+		c := newLoopDrive()
+		s := c.Snapshot()
+		s.CPU.ISR = isr
+		s.CPU.P = 0 // Interrupts enabled
+
+		err := c.Restore(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An interrupt is only taken when not already in the handler
+		taken := c.interrupt() != 0
+		if taken == isr {
+			t.Errorf("ISR %t: interrupt taken = %t", isr, taken)
+		}
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+
+	err := c.LoadSnapshot(strings.NewReader("not a snapshot file"))
+	if err == nil {
+		t.Error("loaded a file without the snapshot header")
+	}
+
+	s := c.Snapshot()
+	s.Version = SNAPSHOT_VERSION + 1
+	err = c.Restore(s)
+	if err == nil {
+		t.Error("restored an unsupported snapshot version")
+	}
+
+	// A snapshot of an unpatched drive can't be restored onto a patched one
+	s = c.Snapshot()
+	err = c.ApplyPatches([]Patch{{0xc000, []Byte{c.bus.Peek(0xc000)}, []Byte{0xea}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Restore(s); err != ErrROMMismatch {
+		t.Errorf("restored onto different ROMs returned %v, want ErrROMMismatch", err)
+	}
+	if err := c.Restore(c.Snapshot()); err != nil {
+		t.Errorf("restoring onto the same patched ROMs: %s", err)
+	}
+}
+
+// The bus lines are saved & given back to the drive when it's restored
+func TestSnapshotBus(t *testing.T) {
+	c := newLoopDrive()
+	bus := &IEEEBus{}
+	host := &DummyConnector{}
+	host.Reset()
+	bus.Attach(host)
+	c.Connect(bus)
+
+	host.Update(func(out *IEEE488) { out.ATN = TRUE })
+	err := c.Step(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.Snapshot()
+	if s.Bus.ATN != TRUE {
+		t.Fatalf("snapshot has ATN %s, want true", s.Bus.ATN.ToOnOff())
+	}
+
+	r := newLoopDrive()
+	err = r.Restore(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Snapshot().Bus; got != s.Bus {
+		t.Errorf("restored bus %+v, want %+v", got, s.Bus)
+	}
+	if !r.via1.CtrlPeek(CTRL_CA1) {
+		t.Error("restored drive doesn't see ATN on CA1")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Symbols maps addresses to labels, e.g. DOS routines & zero page variables
+type Symbols struct {
+	names     map[Word]string
+	addresses map[string]Word
+}
+
+func NewSymbols() *Symbols {
+	return &Symbols{
+		names:     make(map[Word]string),
+		addresses: make(map[string]Word),
+	}
+}
+
+/*
+LoadSymbols reads a VICE label file, which has one label per line:
+
+	al C:e853 .irq_handler
+
+The memory space prefix (C:) & the dot before the label are optional. Lines
+that don't start with "al" are ignored.
+*/
+func LoadSymbols(filename string) (*Symbols, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := NewSymbols()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "al" {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"al address label\"", filename, line)
+		}
+
+		addr := fields[1]
+		if _, a, ok := strings.Cut(addr, ":"); ok {
+			addr = a
+		}
+		a, err := strconv.ParseUint(addr, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid address %q", filename, line, fields[1])
+		}
+
+		s.Add(Word(a), strings.TrimPrefix(fields[2], "."))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Add a label. An address keeps the first label it is given.
+func (s *Symbols) Add(address Word, name string) {
+	if _, ok := s.names[address]; !ok {
+		s.names[address] = name
+	}
+	s.addresses[name] = address
+}
+
+// Name returns the label for an address
+func (s *Symbols) Name(address Word) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	name, ok := s.names[address]
+	return name, ok
+}
+
+// Address returns the address of a label
+func (s *Symbols) Address(name string) (Word, bool) {
+	if s == nil {
+		return 0, false
+	}
+	address, ok := s.addresses[name]
+	return address, ok
+}
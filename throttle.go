@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CLOCK_HZ = 1000000 // The 2031 CPU is clocked at 1MHz
+
+	THROTTLE_INTERVAL = 1000                   // Cycles between checks against the wall clock
+	THROTTLE_MAX_LAG  = 100 * time.Millisecond // Give up catching up when this far behind
+	SPEED_WINDOW      = 500 * time.Millisecond // Period over which the speed is measured
+)
+
+/*
+Throttle paces the drive so that it runs at the same speed as real hardware,
+unless it is in warp mode where it runs as fast as the host allows. Either way
+it measures the speed that was achieved.
+*/
+type Throttle struct {
+	warp atomic.Bool
+
+	checked    uint64    // Cycle count at the last check
+	refCycles  uint64    // Cycle count when the reference time was taken
+	refTime    time.Time // Reference time that cycles are paced against
+	winCycles  uint64    // Cycle count at the start of the speed window
+	winTime    time.Time // Start of the speed window
+	speedMutex sync.Mutex
+	speed      float64 // Achieved speed in Hz
+
+	now   func() time.Time    // Reads the wall clock, time.Now if nil
+	sleep func(time.Duration) // Waits for the wall clock, time.Sleep if nil
+}
+
+// SetWarp switches between warp & real-time
+func (t *Throttle) SetWarp(warp bool) {
+	t.warp.Store(warp)
+}
+
+func (t *Throttle) Warp() bool {
+	return t.warp.Load()
+}
+
+// Speed returns the achieved clock speed in Hz
+func (t *Throttle) Speed() float64 {
+	t.speedMutex.Lock()
+	defer t.speedMutex.Unlock()
+
+	return t.speed
+}
+
+/*
+Restart forgets the reference time & the speed window, e.g. while the drive is
+paused. Speed reads 0 until a window has been measured since, so the time
+spent paused doesn't count against the speed.
+*/
+func (t *Throttle) Restart() {
+	t.refTime = time.Time{}
+
+	t.speedMutex.Lock()
+	t.speed = 0
+	t.speedMutex.Unlock()
+}
+
+// Pace is called with the current cycle count & sleeps if the drive is ahead
+func (t *Throttle) Pace(cycles uint64) {
+	if cycles-t.checked < THROTTLE_INTERVAL {
+		return
+	}
+	// Start pacing afresh if the cycle count jumped, e.g. a snapshot was restored
+	if cycles < t.checked || cycles-t.checked > CLOCK_HZ {
+		t.refTime = time.Time{}
+	}
+	t.checked = cycles
+
+	now := t.clock()
+	if t.refTime.IsZero() {
+		t.reset(cycles, now)
+		t.winCycles, t.winTime = cycles, now
+		return
+	}
+
+	if elapsed := now.Sub(t.winTime); elapsed >= SPEED_WINDOW {
+		t.speedMutex.Lock()
+		t.speed = float64(cycles-t.winCycles) / elapsed.Seconds()
+		t.speedMutex.Unlock()
+
+		t.winCycles, t.winTime = cycles, now
+	}
+
+	// Keep the reference current while in warp, so there's no rush to catch
+	// up when real-time is resumed
+	if t.Warp() {
+		t.reset(cycles, now)
+		return
+	}
+
+	target := t.refTime.Add(time.Duration(cycles-t.refCycles) * time.Second / CLOCK_HZ)
+	switch ahead := target.Sub(now); {
+	case ahead > 0:
+		t.wait(ahead)
+	case ahead < -THROTTLE_MAX_LAG:
+		// The host can't keep up; don't try to make up the lost time
+		t.reset(cycles, now)
+	}
+}
+
+func (t *Throttle) reset(cycles uint64, now time.Time) {
+	t.refCycles = cycles
+	t.refTime = now
+}
+
+func (t *Throttle) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+func (t *Throttle) wait(d time.Duration) {
+	if t.sleep != nil {
+		t.sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// A wall clock that only moves when the throttle sleeps or the host runs
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (f *fakeClock) sleep(d time.Duration) {
+	f.now = f.now.Add(d)
+	f.slept += d
+}
+
+func newFakeThrottle() (*Throttle, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	throttle := &Throttle{
+		now:   func() time.Time { return clock.now },
+		sleep: clock.sleep,
+	}
+	return throttle, clock
+}
+
+/*
+Pace the throttle through the cycles for the given time at 1MHz, on a host
+that takes cost to run each 100 cycles
+*/
+func pace(t *Throttle, clock *fakeClock, start uint64, d, cost time.Duration) uint64 {
+	cycles := start
+	end := start + uint64(d/time.Microsecond)
+	for ; cycles < end; cycles += 100 {
+		clock.now = clock.now.Add(cost)
+		t.Pace(cycles)
+	}
+	return cycles
+}
+
+// Check the speed is within 1% of want
+func checkSpeed(t *testing.T, throttle *Throttle, want float64) {
+	t.Helper()
+
+	if speed := throttle.Speed(); math.Abs(speed-want) > want/100 {
+		t.Errorf("speed %.0fHz, want %.0fHz", speed, want)
+	}
+}
+
+func TestThrottleRealTime(t *testing.T) {
+	throttle, clock := newFakeThrottle()
+
+	// A host that takes no time at all sleeps for all of it, bar the first check
+	d := SPEED_WINDOW + 100*time.Millisecond
+	pace(throttle, clock, 0, d, 0)
+	if diff := d - clock.slept; diff < 0 || diff > 2*time.Millisecond {
+		t.Errorf("slept %s for %s of cycles", clock.slept, d)
+	}
+	checkSpeed(t, throttle, CLOCK_HZ)
+}
+
+// A host that can't keep up runs as fast as it can, without sleeping
+func TestThrottleSlowHost(t *testing.T) {
+	throttle, clock := newFakeThrottle()
+
+	cycles := pace(throttle, clock, 0, SPEED_WINDOW+100*time.Millisecond, 200*time.Microsecond)
+	if clock.slept != 0 {
+		t.Errorf("slept %s while behind", clock.slept)
+	}
+	checkSpeed(t, throttle, CLOCK_HZ/2)
+
+	// No more than THROTTLE_MAX_LAG is made up once the host is fast enough
+	d := 400 * time.Millisecond
+	clock.slept = 0
+	pace(throttle, clock, cycles, d, 0)
+	if clock.slept < d-THROTTLE_MAX_LAG-2*time.Millisecond || clock.slept > d {
+		t.Errorf("slept %s for %s of cycles after falling behind", clock.slept, d)
+	}
+}
+
+func TestThrottleWarp(t *testing.T) {
+	throttle, clock := newFakeThrottle()
+	throttle.SetWarp(true)
+	if !throttle.Warp() {
+		t.Fatal("warp not set")
+	}
+
+	cycles := pace(throttle, clock, 0, 2*time.Second, 50*time.Microsecond)
+	if clock.slept != 0 {
+		t.Errorf("slept %s in warp", clock.slept)
+	}
+	checkSpeed(t, throttle, 2*CLOCK_HZ)
+
+	// Leaving warp doesn't rush to catch up, or sleep to make up the difference
+	throttle.SetWarp(false)
+	start := clock.now
+	pace(throttle, clock, cycles, 100*time.Millisecond, 0)
+	if elapsed := clock.now.Sub(start); elapsed < 99*time.Millisecond || elapsed > 101*time.Millisecond {
+		t.Errorf("100ms of cycles after warp took %s", elapsed)
+	}
+}
+
+// The time spent paused doesn't count towards the speed
+func TestThrottleRestart(t *testing.T) {
+	throttle, clock := newFakeThrottle()
+
+	cycles := pace(throttle, clock, 0, SPEED_WINDOW+100*time.Millisecond, 0)
+	checkSpeed(t, throttle, CLOCK_HZ)
+
+	throttle.Restart()
+	if speed := throttle.Speed(); speed != 0 {
+		t.Errorf("speed %.0fHz after restarting, want 0", speed)
+	}
+
+	// Paused for a while, then resumed
+	clock.now = clock.now.Add(10 * time.Second)
+	clock.slept = 0
+	pace(throttle, clock, cycles, SPEED_WINDOW+100*time.Millisecond, 0)
+	checkSpeed(t, throttle, CLOCK_HZ)
+	if clock.slept > SPEED_WINDOW+101*time.Millisecond {
+		t.Errorf("slept %s after resuming, making up for the pause", clock.slept)
+	}
+}
+
+// Pausing the drive restarts the throttle, so the speed isn't stale
+func TestPauseRestartsThrottle(t *testing.T) {
+	c := mustNewCBM2031(DEFAULT_DEVICE)
+	throttle, _ := newFakeThrottle()
+	c.Throttle = throttle
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(what string, ok func() bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("the speed to be measured", func() bool { return throttle.Speed() != 0 })
+	c.Pause()
+	waitFor("the speed to be cleared", func() bool { return throttle.Speed() == 0 })
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vanders/pet/mos6502"
+)
+
+const (
+	TRACE_INSTRUCTIONS = 1024 // Instructions kept in the trace
+	TRACE_ACCESSES     = 4096 // Bus accesses kept in the trace
+)
+
+// TraceInstruction is the state of the CPU as an instruction was fetched
+type TraceInstruction struct {
+	Sequence      uint64 // Position in the trace
+	Cycle         uint64
+	PC            Word
+	Opcode        Byte
+	A, X, Y, S, P Byte
+	Interrupt     bool // An interrupt was taken rather than an instruction executed
+}
+
+// TraceAccess is a read or write on the bus by an instruction
+type TraceAccess struct {
+	Sequence uint64 // Instruction that made the access
+	Address  Word
+	Data     Byte
+	Write    bool
+}
+
+/*
+Trace is a ring buffer of the most recently executed instructions & the bus
+accesses they made. It is cheap enough to be left running all of the time, so
+that the lead up to a crash is always available.
+*/
+type Trace struct {
+	instructions [TRACE_INSTRUCTIONS]TraceInstruction
+	accesses     [TRACE_ACCESSES]TraceAccess
+	count        uint64 // Instructions recorded
+	accessCount  uint64 // Accesses recorded
+}
+
+func (t *Trace) instruction(cycle uint64, cpu *mos6502.CPU, opcode Byte, interrupt bool) {
+	t.instructions[t.count%TRACE_INSTRUCTIONS] = TraceInstruction{
+		Sequence:  t.count,
+		Cycle:     cycle,
+		PC:        cpu.PC.Get(),
+		Opcode:    opcode,
+		A:         cpu.Registers.A.Get(),
+		X:         cpu.Registers.X.Get(),
+		Y:         cpu.Registers.Y.Get(),
+		S:         cpu.Registers.S.Get(),
+		P:         cpu.Registers.P.GetByte(),
+		Interrupt: interrupt,
+	}
+	t.count++
+}
+
+func (t *Trace) access(address Word, data Byte, write bool) {
+	if t.count == 0 {
+		return
+	}
+
+	t.accesses[t.accessCount%TRACE_ACCESSES] = TraceAccess{
+		Sequence: t.count - 1,
+		Address:  address,
+		Data:     data,
+		Write:    write,
+	}
+	t.accessCount++
+}
+
+// Instructions returns the instructions in the trace, oldest first
+func (t *Trace) Instructions() []TraceInstruction {
+	n := t.count
+	if n > TRACE_INSTRUCTIONS {
+		n = TRACE_INSTRUCTIONS
+	}
+
+	trace := make([]TraceInstruction, 0, n)
+	for seq := t.count - n; seq < t.count; seq++ {
+		trace = append(trace, t.instructions[seq%TRACE_INSTRUCTIONS])
+	}
+	return trace
+}
+
+// Accesses returns the bus accesses in the trace, oldest first
+func (t *Trace) Accesses() []TraceAccess {
+	n := t.accessCount
+	if n > TRACE_ACCESSES {
+		n = TRACE_ACCESSES
+	}
+
+	trace := make([]TraceAccess, 0, n)
+	for seq := t.accessCount - n; seq < t.accessCount; seq++ {
+		trace = append(trace, t.accesses[seq%TRACE_ACCESSES])
+	}
+	return trace
+}
+
+func (i TraceInstruction) String() string {
+	if i.Interrupt {
+		return fmt.Sprintf("%10d  $%04x  IRQ", i.Cycle, i.PC)
+	}
+	return fmt.Sprintf("%10d  $%04x  %02x   A:%02x X:%02x Y:%02x S:%02x P:%s",
+		i.Cycle, i.PC, i.Opcode, i.A, i.X, i.Y, i.S, flags(i.P))
+}
+
+func (a TraceAccess) String() string {
+	if a.Write {
+		return fmt.Sprintf("W $%04x = $%02x", a.Address, a.Data)
+	}
+	return fmt.Sprintf("R $%04x = $%02x", a.Address, a.Data)
+}
+
+// Decode the status register, with clear flags shown as '-'
+func flags(p Byte) string {
+	const names = "NV-BDIZC"
+
+	s := []byte(names)
+	for n := range s {
+		if p&(0x80>>n) == 0 {
+			s[n] = '-'
+		}
+	}
+	return string(s)
+}
+
+// WriteTrace writes the trace, with each instruction followed by its accesses
+func (t *Trace) WriteTrace(w io.Writer) {
+	accesses := t.Accesses()
+
+	for _, i := range t.Instructions() {
+		fmt.Fprintln(w, i)
+
+		for len(accesses) > 0 && accesses[0].Sequence <= i.Sequence {
+			if accesses[0].Sequence == i.Sequence {
+				fmt.Fprintf(w, "%20s%s\n", "", accesses[0])
+			}
+			accesses = accesses[1:]
+		}
+	}
+}
+
+// RecentInstructions returns up to n of the most recently executed instructions
+func (c *CBM2031) RecentInstructions(n int) []TraceInstruction {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	trace := c.trace.Instructions()
+	if len(trace) > n {
+		trace = trace[len(trace)-n:]
+	}
+	return trace
+}
+
+/*
+WriteCrashReport writes the error that stopped execution, the trace, the CPU
+registers & the complete state of the RAM & VIAs to a file
+*/
+func (c *CBM2031) WriteCrashReport(filename string, cause error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.crashReport(filename, cause)
+}
+
+func (c *CBM2031) crashReport(filename string, cause error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	c.writeCrashReport(f, cause)
+
+	return f.Close()
+}
+
+func (c *CBM2031) writeCrashReport(w io.Writer, cause error) {
+	s := c.snapshot()
+
+	fmt.Fprintf(w, "%s\n", cause)
+	fmt.Fprintf(w, "cycle %d, instruction %d\n\n", s.Cycles, c.instructions)
+
+	fmt.Fprintln(w, "Registers")
+	fmt.Fprintf(w, "%s ISR:%t\n\n", s.CPU, s.CPU.ISR)
+
+	fmt.Fprintln(w, "Trace")
+	c.trace.WriteTrace(w)
+	fmt.Fprintln(w)
+
+	for _, v := range []struct {
+		name string
+		via  *VIA
+	}{{"VIA1", c.via1}, {"VIA2", c.via2}} {
+		fmt.Fprintf(w, "%s at $%04x\n", v.name, v.via.Base)
+		for r := VIARegister(0); r < 16; r++ {
+			fmt.Fprintf(w, "%02x ", v.via.PeekRegister(r))
+		}
+		fmt.Fprintf(w, "\n%+v\n\n", v.via.State())
+	}
+
+	fmt.Fprintln(w, "RAM")
+	for n := 0; n < len(s.RAM); n += 16 {
+		fmt.Fprintf(w, "$%04x:", c.ram.Base+Word(n))
+		for _, b := range s.RAM[n : n+16] {
+			fmt.Fprintf(w, " %02x", b)
+		}
+		fmt.Fprintln(w)
+	}
+}
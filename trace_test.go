@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTraceWraps(t *testing.T) {
+	c := newLoopDrive()
+
+	err := c.Step(TRACE_INSTRUCTIONS + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := c.trace.Instructions()
+	if len(trace) != TRACE_INSTRUCTIONS {
+		t.Fatalf("trace has %d instructions, want %d", len(trace), TRACE_INSTRUCTIONS)
+	}
+	for n := 1; n < len(trace); n++ {
+		if trace[n].Sequence != trace[n-1].Sequence+1 || trace[n].Cycle <= trace[n-1].Cycle {
+			t.Fatalf("trace out of order at %d: %v then %v", n, trace[n-1], trace[n])
+		}
+	}
+
+	last := trace[len(trace)-1]
+	if last.PC != 0x301 || last.Opcode != 0x4c {
+		t.Errorf("last instruction = %v, want JMP at $0301", last)
+	}
+}
+
+func TestTraceAccesses(t *testing.T) {
+	c := newLoopDrive()
+	c.ram.Write(0x300, 0x8d) // STA $0234
+	c.ram.Write(0x301, 0x34)
+	c.ram.Write(0x302, 0x02)
+	c.cpu.Registers.A.Set(0x55)
+
+	err := c.Step(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, a := range c.trace.Accesses() {
+		if a.Write && a.Address == 0x0234 && a.Data == 0x55 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("write to $0234 not traced: %v", c.trace.Accesses())
+	}
+}
+
+func TestCrashReport(t *testing.T) {
+	c := newLoopDrive()
+	c.CrashReport = filepath.Join(t.TempDir(), "crash.txt")
+	c.ram.Write(0x301, 0x02) // JAM after the INX
+
+	err := c.Run(context.Background())
+	if !errors.Is(err, ErrJAM) {
+		t.Fatalf("Run returned %v, want ErrJAM", err)
+	}
+
+	var execErr *ExecutionError
+	if !errors.As(err, &execErr) || execErr.Report != c.CrashReport {
+		t.Fatalf("crash report not written: %v", err)
+	}
+
+	report, err := os.ReadFile(c.CrashReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"execution stopped at $0301: CPU jammed", "$0300  e8", "VIA1 at $1800", "$1ff0:"} {
+		if !strings.Contains(string(report), want) {
+			t.Errorf("crash report does not contain %q", want)
+		}
+	}
+}
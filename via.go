@@ -1,8 +1,6 @@
 package main
 
 import (
-	"fmt"
-
 	"github.com/vanders/pet/mos6502"
 )
 
@@ -15,18 +13,35 @@ type (
 type VIA struct {
 	Base Word
 
-	portB    Byte
-	portBOut Byte
+	portB    Byte // Output register B
+	portBIn  Byte // State of the port B input pins
 	portBDir Byte
-	portA    Byte
-	portAOut Byte
+	portA    Byte // Output register A
+	portAIn  Byte // State of the port A input pins
 	portADir Byte
 
-	timer1Low       Byte
-	timer1High      Byte
+	portALatch Byte // Port A inputs latched by CA1
+	portBLatch Byte // Port B inputs latched by CB1
+
 	timer1LatchLow  Byte
 	timer1LatchHigh Byte
 	timer1Counter   Word
+	timer1Load      bool // T1 was loaded on this cycle & will not decrement
+	timer1Reload    bool // T1 reloads from the latches on this cycle
+	timer1Armed     bool // T1 will raise an interrupt when it next times out
+	timer1PB7Low    bool // T1 output on PB7 is low
+
+	timer2LatchLow Byte
+	timer2Counter  Word
+	timer2Load     bool // T2 was loaded on this cycle & will not decrement
+	timer2Armed    bool // T2 will raise an interrupt when it next times out
+
+	sr         Byte // Shift register
+	srActive   bool // Shifting is in progress
+	srCount    int  // Number of bits shifted
+	srTimer    Word // Counts down the T2 rate for the shift clock
+	srClockLow bool // Shift clock output on CB1 is low
+	srData     bool // Shift data output on CB2
 
 	acr Byte // Auxillery Control Register
 	pcr Byte // Peripheral Control Register
@@ -38,6 +53,25 @@ type VIA struct {
 	ca2 bool // Current state of the CA2 line
 	cb1 bool // Current state of the CB1 line
 	cb2 bool // Current state of the CB2 line
+
+	ca2Low   bool // CA2 handshake or pulse output is low
+	ca2Pulse bool // CA2 pulse output returns high on the next clock
+	cb2Low   bool // CB2 handshake or pulse output is low
+	cb2Pulse bool // CB2 pulse output returns high on the next clock
+}
+
+/*
+Reset clears the registers as the RES pin does. The timers & the shift
+register keep their values, and the input pins are left as they are.
+*/
+func (v *VIA) Reset() {
+	v.portA, v.portADir = 0, 0
+	v.portB, v.portBDir = 0, 0
+	v.acr, v.pcr = 0, 0
+	v.ifr, v.ie = 0, 0
+	v.srActive = false
+	v.ca2Low, v.ca2Pulse = false, false
+	v.cb2Low, v.cb2Pulse = false, false
 }
 
 func (v *VIA) GetBase() Word {
@@ -53,22 +87,166 @@ func (v *VIA) CheckInterrupt() bool {
 }
 
 func (v *VIA) Clock() {
-	t1start := v.timer1Counter
+	v.clockTimer1()
 
-	if v.timer1Counter > 0 {
-		v.timer1Counter = v.timer1Counter - 1
+	// In pulse counting mode T2 is decremented by PB6, not the clock
+	if v.acr&ACR_T2_PULSE_COUNT == 0 {
+		v.clockTimer2()
+	}
+
+	v.clockShiftRegister()
+
+	// Pulse outputs only last for a single cycle
+	if v.ca2Pulse {
+		v.ca2Pulse = false
+		v.ca2Low = false
+	}
+	if v.cb2Pulse {
+		v.cb2Pulse = false
+		v.cb2Low = false
+	}
+}
+
+/*
+IdleCycles returns the number of cycles that the VIA can be clocked for without
+anything happening other than the counters decrementing
+*/
+func (v *VIA) IdleCycles() int {
+	idle := NO_EVENT
+
+	// Pulse outputs end on the next clock
+	if v.ca2Pulse || v.cb2Pulse {
+		return 0
+	}
+
+	// T1 always times out in free-run mode, but only once in one-shot mode
+	switch {
+	case v.timer1Load || v.timer1Reload:
+		return 0
+	case v.acr&ACR_T1_CONTINUOUS != 0 || v.timer1Armed:
+		idle = int(v.timer1Counter)
+	}
+
+	if v.acr&ACR_T2_PULSE_COUNT == 0 {
+		switch {
+		case v.timer2Load:
+			return 0
+		case v.timer2Armed && int(v.timer2Counter) < idle:
+			idle = int(v.timer2Counter)
+		}
 	}
-	//fmt.Printf("$%04x t1=0x%02x, acr=0x%02x, ie=0x%02x\r", v.Base, v.timer1Counter, v.acr, v.ie)
 
-	// Did T1 decrement to 0? If so raise an interrupt
-	if t1start > 0 && v.timer1Counter == 0 {
-		v.setInterrupt(INT_T1)
+	if v.srActive {
+		switch v.acr & ACR_SR_CTRL {
+		case SR_IN_T2, SR_OUT_FREE_T2, SR_OUT_T2:
+			if int(v.srTimer) < idle {
+				idle = int(v.srTimer)
+			}
+		case SR_IN_PHI2, SR_OUT_PHI2:
+			return 0
+		}
+	}
+
+	return idle
+}
+
+// Advance clocks the VIA for a number of cycles, skipping over idle cycles
+func (v *VIA) Advance(cycles int) {
+	for cycles > 0 {
+		idle := v.IdleCycles()
+		if idle == 0 {
+			v.Clock()
+			cycles--
+			continue
+		}
+		if idle > cycles {
+			idle = cycles
+		}
 
-		// If T1 is in continuous mode, reload the counter
-		if v.acr&mos6502.BIT_6 != 0 {
-			//fmt.Println("loading T1")
-			v.setTimer1Counter()
+		// Only the counters change during idle cycles
+		v.timer1Counter = v.timer1Counter - Word(idle)
+		if v.acr&ACR_T2_PULSE_COUNT == 0 {
+			v.timer2Counter = v.timer2Counter - Word(idle)
+		}
+		if v.srActive {
+			switch v.acr & ACR_SR_CTRL {
+			case SR_IN_T2, SR_OUT_FREE_T2, SR_OUT_T2:
+				v.srTimer = v.srTimer - Word(idle)
+			}
 		}
+		cycles -= idle
+	}
+}
+
+/*
+T1 decrements on every clock. When the counter rolls over from 0 to $ffff, N+1.5
+cycles after it was loaded, the timer times out:
+
+In one-shot mode the interrupt is raised & PB7 returns high. The counter
+continues to decrement without raising further interrupts until it is reloaded.
+
+In free-run mode the interrupt is raised & PB7 is inverted on every time out.
+The counter holds $ffff for a cycle & is then reloaded from the latches, so
+the interrupts are N+2 cycles apart.
+*/
+func (v *VIA) clockTimer1() {
+	switch {
+	case v.timer1Load:
+		// The counter does not decrement on the cycle it is loaded
+		v.timer1Load = false
+	case v.timer1Reload:
+		v.timer1Reload = false
+		v.setTimer1Counter()
+	default:
+		v.timer1Counter = v.timer1Counter - 1
+		if v.timer1Counter != 0xffff {
+			break
+		}
+
+		if v.acr&ACR_T1_CONTINUOUS != 0 {
+			v.timer1Reload = true
+			v.timer1PB7Low = !v.timer1PB7Low
+			v.setInterrupt(INT_T1)
+		} else if v.timer1Armed {
+			v.timer1Armed = false
+			v.timer1PB7Low = false
+			v.setInterrupt(INT_T1)
+		}
+	}
+}
+
+/*
+In one-shot mode T2 decrements on every clock. The interrupt is raised when
+the counter rolls over from 0 to $ffff, N+1.5 cycles after it was loaded, and
+the counter then continues to decrement without raising further interrupts
+until it is reloaded.
+*/
+func (v *VIA) clockTimer2() {
+	if v.timer2Load {
+		// The counter does not decrement on the cycle it is loaded
+		v.timer2Load = false
+		return
+	}
+
+	v.timer2Counter = v.timer2Counter - 1
+	if v.timer2Counter == 0xffff && v.timer2Armed {
+		v.timer2Armed = false
+		v.setInterrupt(INT_T2)
+	}
+}
+
+/*
+In pulse counting mode T2 decrements on every negative transition of PB6. The
+interrupt is raised when the counter reaches zero, and the counter then
+continues to decrement without raising further interrupts until it is
+reloaded.
+*/
+func (v *VIA) countTimer2() {
+	v.timer2Load = false
+	v.timer2Counter = v.timer2Counter - 1
+	if v.timer2Counter == 0 && v.timer2Armed {
+		v.timer2Armed = false
+		v.setInterrupt(INT_T2)
 	}
 }
 
@@ -76,6 +254,7 @@ func (v *VIA) Clock() {
 const (
 	INT_CA2 VIAInterrupt = 1 << 0
 	INT_CA1 VIAInterrupt = 1 << 1
+	INT_SR  VIAInterrupt = 1 << 2
 
 	INT_CB2 VIAInterrupt = 1 << 3
 	INT_CB1 VIAInterrupt = 1 << 4
@@ -119,10 +298,22 @@ const (
 	TIMER_1_LATCH_HIGH VIARegister = 0x7
 	TIMER_2_LOW        VIARegister = 0x8
 	TIMER_2_HIGH       VIARegister = 0x9
+	SHIFT              VIARegister = 0xa // Shift register
 	AUXILLERY_CTRL     VIARegister = 0xb // Auxillery control
 	PERIPHERAL_CTRL    VIARegister = 0xc // Peripheral control
 	INT_FLAGS          VIARegister = 0xd // Interrupt flag register (IFR)
 	INT_ENABLE         VIARegister = 0xe // Interrupt enable register
+	PORT_A_NHS         VIARegister = 0xf // Port A without handshake
+)
+
+// Auxillery Control Register bits
+const (
+	ACR_PA_LATCH       = 1 << 0 // Latch port A inputs on CA1
+	ACR_PB_LATCH       = 1 << 1 // Latch port B inputs on CB1
+	ACR_SR_CTRL        = 0x1c   // Shift register mode
+	ACR_T2_PULSE_COUNT = 1 << 5 // T2 counts pulses on PB6
+	ACR_T1_CONTINUOUS  = 1 << 6 // T1 reloads from the latches on timeout
+	ACR_T1_PB7         = 1 << 7 // T1 drives PB7
 )
 
 func (v *VIA) setTimer1Counter() {
@@ -136,26 +327,37 @@ func (v *VIA) ReadRegister(r VIARegister) Byte {
 		if v.pcr&PCR_CB2_1 == 0 {
 			v.clearInterrupt(INT_CB2)
 		}
-		return v.portB
+		return v.readPortB()
 	case PORT_A:
 		v.clearInterrupt(INT_CA1)
 		if v.pcr&PCR_CA2_1 == 0 {
 			v.clearInterrupt(INT_CA2)
 		}
-		return v.portA
+		v.handshakeCA2()
+		return v.readPortA()
+	case PORT_A_NHS:
+		return v.readPortA()
 	case PORT_B_DIR:
 		return v.portBDir
 	case PORT_A_DIR:
 		return v.portADir
 	case TIMER_1_LOW:
 		v.clearInterrupt(INT_T1)
-		return v.timer1Low
+		return Byte(v.timer1Counter & 0xff)
 	case TIMER_1_HIGH:
-		return v.timer1High
+		return Byte(v.timer1Counter >> 8)
 	case TIMER_1_LATCH_LOW:
 		return v.timer1LatchLow
 	case TIMER_1_LATCH_HIGH:
 		return v.timer1LatchHigh
+	case TIMER_2_LOW:
+		v.clearInterrupt(INT_T2)
+		return Byte(v.timer2Counter & 0xff)
+	case TIMER_2_HIGH:
+		return Byte(v.timer2Counter >> 8)
+	case SHIFT:
+		v.startShiftRegister()
+		return v.sr
 	case AUXILLERY_CTRL:
 		return v.acr
 	case PERIPHERAL_CTRL:
@@ -163,26 +365,75 @@ func (v *VIA) ReadRegister(r VIARegister) Byte {
 	case INT_FLAGS:
 		return v.ifr
 	case INT_ENABLE:
-		return v.ie
+		// Bit 7 always reads back as 1
+		return v.ie | 0x80
 	}
 
 	return Byte(0)
 }
 
+/*
+When input latching is enabled, reads return the state of the input pins when
+the latch was last triggered by CA1/CB1
+*/
+func (v *VIA) readPortA() Byte {
+	if v.acr&ACR_PA_LATCH != 0 {
+		return v.portALatch
+	}
+	return v.pinsA()
+}
+
+// Output pins read back from the output register B, input pins from the pins
+func (v *VIA) readPortB() Byte {
+	in := v.portBIn
+	if v.acr&ACR_PB_LATCH != 0 {
+		in = v.portBLatch
+	}
+	return v.timer1PB7((v.portB & v.portBDir) | (in & ^v.portBDir))
+}
+
+// The state of the port A pins, whether they are inputs or outputs
+func (v *VIA) pinsA() Byte {
+	return (v.portA & v.portADir) | (v.portAIn & ^v.portADir)
+}
+
+// When T1 is driving PB7 it overrides the port B output
+func (v *VIA) timer1PB7(data Byte) Byte {
+	if v.acr&ACR_T1_PB7 == 0 {
+		return data
+	}
+
+	data = data & ^Byte(mos6502.BIT_7)
+	if !v.timer1PB7Low {
+		data = data | mos6502.BIT_7
+	}
+	return data
+}
+
 func (v *VIA) PeekRegister(r VIARegister) Byte {
 	switch r {
 	case PORT_B:
-		return v.portB
+		return v.readPortB()
 	case PORT_B_DIR:
 		return v.portBDir
-	case PORT_A:
-		return v.portA
+	case PORT_A, PORT_A_NHS:
+		return v.readPortA()
 	case PORT_A_DIR:
 		return v.portADir
 	case TIMER_1_LOW:
-		return v.timer1Low
+		return Byte(v.timer1Counter & 0xff)
 	case TIMER_1_HIGH:
-		return v.timer1High
+		return Byte(v.timer1Counter >> 8)
+	case TIMER_1_LATCH_LOW:
+		return v.timer1LatchLow
+	case TIMER_1_LATCH_HIGH:
+		return v.timer1LatchHigh
+	case TIMER_2_LOW:
+		return Byte(v.timer2Counter & 0xff)
+	case TIMER_2_HIGH:
+		return Byte(v.timer2Counter >> 8)
+	case SHIFT:
+		return v.sr
 	case AUXILLERY_CTRL:
 		return v.acr
 	case PERIPHERAL_CTRL:
@@ -190,7 +441,8 @@ func (v *VIA) PeekRegister(r VIARegister) Byte {
 	case INT_FLAGS:
 		return v.ifr
 	case INT_ENABLE:
-		return v.ie
+		// Bit 7 always reads back as 1
+		return v.ie | 0x80
 	}
 
 	return Byte(0)
@@ -204,7 +456,7 @@ func (v *VIA) WriteRegister(r VIARegister, data Byte) {
 		if v.pcr&PCR_CB2_1 == 0 {
 			v.clearInterrupt(INT_CB2)
 		}
-		v.portBOut = v.portB & v.portBDir
+		v.handshakeCB2()
 	case PORT_B_DIR:
 		v.portBDir = data
 	case PORT_A:
@@ -213,49 +465,60 @@ func (v *VIA) WriteRegister(r VIARegister, data Byte) {
 		if v.pcr&PCR_CA2_1 == 0 {
 			v.clearInterrupt(INT_CA2)
 		}
-		v.portAOut = v.portA & v.portADir
+		v.handshakeCA2()
+	case PORT_A_NHS:
+		v.portA = data
 	case PORT_A_DIR:
 		v.portADir = data
 	case TIMER_1_LOW:
-		v.timer1Low = data
 		v.timer1LatchLow = data
 	case TIMER_1_HIGH:
-		v.timer1High = data
 		v.timer1LatchHigh = data
-		v.timer1Low = v.timer1LatchLow
+		v.setTimer1Counter()
+		v.timer1Load = true
+		v.timer1Reload = false
+		v.timer1Armed = true
+
+		// PB7 goes low when T1 is loaded
+		v.timer1PB7Low = true
 
 		v.clearInterrupt(INT_T1)
-		v.setTimer1Counter()
 	case TIMER_1_LATCH_LOW:
 		v.timer1LatchLow = data
 	case TIMER_1_LATCH_HIGH:
 		v.timer1LatchHigh = data
 		v.clearInterrupt(INT_T1)
+	case TIMER_2_LOW:
+		v.timer2LatchLow = data
+	case TIMER_2_HIGH:
+		v.timer2Counter = Word(data)<<8 | Word(v.timer2LatchLow)
+		v.timer2Load = true
+		v.timer2Armed = true
+
+		v.clearInterrupt(INT_T2)
+	case SHIFT:
+		v.sr = data
+		v.startShiftRegister()
 	case AUXILLERY_CTRL:
 		v.acr = data
 	case PERIPHERAL_CTRL:
 		v.pcr = data
+
+		// Handshake & pulse outputs start high
+		v.ca2Low, v.ca2Pulse = false, false
+		v.cb2Low, v.cb2Pulse = false, false
 	case INT_FLAGS:
-		if data&INT_CA2 != 0 {
-			v.clearInterrupt(INT_CA2)
-		}
-		if data&INT_CA1 != 0 {
-			v.clearInterrupt(INT_CA1)
-		}
-		if data&INT_CB2 != 0 {
-			v.clearInterrupt(INT_CB2)
-		}
-		if data&INT_CB1 != 0 {
-			v.clearInterrupt(INT_CB1)
-		}
+		// Writing a 1 clears the flag; the IRQ bit can't be cleared directly
+		v.clearInterrupt(data & 0x7f)
 	case INT_ENABLE:
 		if data&0x80 == 0 {
 			// Clear
-			v.ie = (^v.ie | ^data) & 0x7f
+			v.ie = (v.ie & ^data) & 0x7f
 		} else {
 			// Set
 			v.ie = (v.ie | data) & 0x7f
 		}
+		v.setOrClearIRQ()
 	}
 }
 
@@ -266,6 +529,11 @@ func (v *VIA) Read(addr Word) Byte {
 	return v.ReadRegister(r)
 }
 
+func (v *VIA) Peek(addr Word) Byte {
+	r := Byte(addr - v.Base)
+	return v.PeekRegister(r)
+}
+
 func (v *VIA) Write(addr Word, data Byte) {
 	r := Byte(addr - v.Base)
 	v.WriteRegister(r, data)
@@ -283,9 +551,9 @@ func (v *VIA) Out(r VIARegister) Byte {
 	var data Byte
 	switch r {
 	case PORT_A:
-		data = v.portAOut
+		data = v.portA & v.portADir
 	case PORT_B:
-		data = v.portBOut
+		data = v.timer1PB7(v.portB & v.portBDir)
 	}
 	return data
 }
@@ -293,19 +561,15 @@ func (v *VIA) Out(r VIARegister) Byte {
 func (v *VIA) In(r VIARegister, data Byte) {
 	switch r {
 	case PORT_A:
-		dir := v.ReadRegister(PORT_A_DIR)
-
-		in := data & ^dir
-		portA := v.portA & dir
-
-		v.portA = in | portA
+		v.portAIn = data
 	case PORT_B:
-		dir := v.ReadRegister(PORT_B_DIR)
-
-		in := data & ^dir
-		portB := v.portB & dir
+		// Count negative transitions on PB6 when T2 is in pulse counting mode
+		pb6 := v.portBIn&mos6502.BIT_6 != 0
+		if pb6 && data&mos6502.BIT_6 == 0 && v.acr&ACR_T2_PULSE_COUNT != 0 {
+			v.countTimer2()
+		}
 
-		v.portB = in | portB
+		v.portBIn = data
 	}
 }
 
@@ -332,13 +596,72 @@ const (
 	PCR_CB2_CTRL = 0xe0
 )
 
+// CA2 & CB2 modes, selected by PCR bits 1-3 & 5-7
+const (
+	CTRL_INPUT_NEG       = 0 // Interrupt on a negative edge
+	CTRL_INPUT_NEG_INDEP = 1 // Interrupt on a negative edge, not cleared by port access
+	CTRL_INPUT_POS       = 2 // Interrupt on a positive edge
+	CTRL_INPUT_POS_INDEP = 3 // Interrupt on a positive edge, not cleared by port access
+	CTRL_HANDSHAKE       = 4 // Handshake output
+	CTRL_PULSE           = 5 // Pulse output
+	CTRL_LOW             = 6 // Manual output, low
+	CTRL_HIGH            = 7 // Manual output, high
+)
+
+func (v *VIA) ca2Mode() Byte {
+	return (v.pcr & PCR_CA2_CTRL) >> 1
+}
+
+func (v *VIA) cb2Mode() Byte {
+	return (v.pcr & PCR_CB2_CTRL) >> 5
+}
+
+/*
+In handshake mode CA2 goes low on a read or write of port A, and returns high
+on the next active edge of CA1. In pulse mode it goes low for a single cycle.
+*/
+func (v *VIA) handshakeCA2() {
+	switch v.ca2Mode() {
+	case CTRL_HANDSHAKE:
+		v.ca2Low = true
+	case CTRL_PULSE:
+		v.ca2Low = true
+		v.ca2Pulse = true
+	}
+}
+
+// CB2 handshakes in the same way as CA2, but only on a write to port B
+func (v *VIA) handshakeCB2() {
+	switch v.cb2Mode() {
+	case CTRL_HANDSHAKE:
+		v.cb2Low = true
+	case CTRL_PULSE:
+		v.cb2Low = true
+		v.cb2Pulse = true
+	}
+}
+
 func (v *VIA) ctrlInSet(c VIAControl) {
 	switch c {
 	case CTRL_CA1:
+		// Latch port A & complete the CA2 handshake
+		if v.acr&ACR_PA_LATCH != 0 {
+			v.portALatch = v.pinsA()
+		}
+		if v.ca2Mode() == CTRL_HANDSHAKE {
+			v.ca2Low = false
+		}
 		v.setInterrupt(INT_CA1)
 	case CTRL_CA2:
 		v.setInterrupt(INT_CA2)
 	case CTRL_CB1:
+		// Latch port B & complete the CB2 handshake
+		if v.acr&ACR_PB_LATCH != 0 {
+			v.portBLatch = v.portBIn
+		}
+		if v.cb2Mode() == CTRL_HANDSHAKE {
+			v.cb2Low = false
+		}
 		v.setInterrupt(INT_CB1)
 	case CTRL_CB2:
 		v.setInterrupt(INT_CB2)
@@ -352,8 +675,7 @@ func (v *VIA) CtrlIn(c VIAControl, ttl bool) {
 	case CTRL_CA1:
 		currentTTL = v.ca1
 	case CTRL_CA2:
-		ca2_ctrl := v.PeekRegister(PERIPHERAL_CTRL) & PCR_CA2_CTRL
-		if ca2_ctrl&PCR_CA2_3 != 0 {
+		if v.ca2Mode() >= CTRL_HANDSHAKE {
 			// CA2 is in output mode
 			return
 		}
@@ -361,8 +683,7 @@ func (v *VIA) CtrlIn(c VIAControl, ttl bool) {
 	case CTRL_CB1:
 		currentTTL = v.cb1
 	case CTRL_CB2:
-		cb2_ctrl := v.PeekRegister(PERIPHERAL_CTRL) & PCR_CB2_CTRL
-		if cb2_ctrl&PCR_CB2_3 != 0 {
+		if v.cb2Mode() >= CTRL_HANDSHAKE {
 			// CB2 is in output mode
 			return
 		}
@@ -393,63 +714,81 @@ func (v *VIA) CtrlIn(c VIAControl, ttl bool) {
 	case CTRL_CA1:
 		if v.pcr&PCR_CA1_CTRL == 0 && transition == HI_TO_LO {
 			// Negative transition (high to low)
-			fmt.Println("CA1 negative transition (high to low)")
 			v.ctrlInSet(c)
 		}
-		if v.pcr&PCR_CA1_CTRL == 1 && transition == LO_TO_HI {
+		if v.pcr&PCR_CA1_CTRL != 0 && transition == LO_TO_HI {
 			// Positive transition (low to high)
-			fmt.Println("CA1 positive transition (low to high)")
 			v.ctrlInSet(c)
 		}
 		v.ca1 = ttl
 	case CTRL_CA2:
-		if v.pcr&PCR_CA2_3 == 0 { // Is CA2 in Input mode?
-			// Is it in positive or negative mode?
-			if v.pcr&PCR_CA2_2 == 0 && transition == HI_TO_LO {
-				// Negative transition (high to low)
-				v.ctrlInSet(c)
-			}
-			if v.pcr&PCR_CA2_2 == 1 && transition == LO_TO_HI {
-				// Positive transition (low to high)
-				v.ctrlInSet(c)
-			}
-			v.ca2 = ttl
+		// Is it in positive or negative mode?
+		if v.pcr&PCR_CA2_2 == 0 && transition == HI_TO_LO {
+			// Negative transition (high to low)
+			v.ctrlInSet(c)
+		}
+		if v.pcr&PCR_CA2_2 != 0 && transition == LO_TO_HI {
+			// Positive transition (low to high)
+			v.ctrlInSet(c)
 		}
+		v.ca2 = ttl
 	case CTRL_CB1:
 		if v.pcr&PCR_CB1_CTRL == 0 && transition == HI_TO_LO {
 			// Negative transition (high to low)
 			v.ctrlInSet(c)
 		}
-		if v.pcr&PCR_CB1_CTRL == 1 && transition == LO_TO_HI {
+		if v.pcr&PCR_CB1_CTRL != 0 && transition == LO_TO_HI {
 			// Positive transition (low to high)
 			v.ctrlInSet(c)
 		}
 		v.cb1 = ttl
-	case CTRL_CB2:
-		if v.pcr&PCR_CB2_3 == 0 { // Is CB2 in Input mode?
-			// Is it in positive or negative mode?
-			if v.pcr&PCR_CB2_2 == 0 && transition == HI_TO_LO {
-				// Negative transition (high to low)
-				v.ctrlInSet(c)
-			}
-			if v.pcr&PCR_CB2_2 == 1 && transition == LO_TO_HI {
-				// Positive transtion (low to high)
-				v.ctrlInSet(c)
+
+		// CB1 may be the shift register's external clock
+		switch v.acr & ACR_SR_CTRL {
+		case SR_IN_CB1, SR_OUT_CB1:
+			if v.srActive {
+				v.shift(transition == LO_TO_HI)
 			}
-			v.cb2 = ttl
 		}
+	case CTRL_CB2:
+		// Is it in positive or negative mode?
+		if v.pcr&PCR_CB2_2 == 0 && transition == HI_TO_LO {
+			// Negative transition (high to low)
+			v.ctrlInSet(c)
+		}
+		if v.pcr&PCR_CB2_2 != 0 && transition == LO_TO_HI {
+			// Positive transtion (low to high)
+			v.ctrlInSet(c)
+		}
+		v.cb2 = ttl
 	}
 }
 
 func (v *VIA) CtrlOut(c VIAControl) bool {
 	switch c {
+	case CTRL_CB1:
+		// The shift register drives CB1 when it is using an internal clock
+		switch v.acr & ACR_SR_CTRL {
+		case SR_IN_T2, SR_IN_PHI2, SR_OUT_FREE_T2, SR_OUT_T2, SR_OUT_PHI2:
+			return !v.srClockLow
+		}
 	case CTRL_CA2:
-		if v.pcr&PCR_CA2_3 != 0 {
-			return (v.pcr & PCR_CA2_1) != 0
+		switch v.ca2Mode() {
+		case CTRL_HANDSHAKE, CTRL_PULSE:
+			return !v.ca2Low
+		case CTRL_HIGH:
+			return true
 		}
 	case CTRL_CB2:
-		if v.pcr&PCR_CB2_3 != 0 {
-			return (v.pcr & PCR_CB2_1) != 0
+		// The shift register drives CB2 when it is shifting out
+		if v.acr&SR_OUT != 0 {
+			return v.srData
+		}
+		switch v.cb2Mode() {
+		case CTRL_HANDSHAKE, CTRL_PULSE:
+			return !v.cb2Low
+		case CTRL_HIGH:
+			return true
 		}
 	}
 	return false
@@ -470,3 +809,206 @@ func (v *VIA) CtrlPeek(c VIAControl) bool {
 	}
 	return currentTTL
 }
+
+// Shift register modes, selected by ACR bits 2-4
+const (
+	SR_DISABLED    = 0 << 2
+	SR_IN_T2       = 1 << 2 // Shift in under control of T2
+	SR_IN_PHI2     = 2 << 2 // Shift in under control of the system clock
+	SR_IN_CB1      = 3 << 2 // Shift in under control of an external clock on CB1
+	SR_OUT_FREE_T2 = 4 << 2 // Shift out continuously at the T2 rate
+	SR_OUT_T2      = 5 << 2 // Shift out under control of T2
+	SR_OUT_PHI2    = 6 << 2 // Shift out under control of the system clock
+	SR_OUT_CB1     = 7 << 2 // Shift out under control of an external clock on CB1
+
+	SR_OUT = 1 << 4 // Set for all of the shift out modes
+)
+
+/*
+Reading or writing the shift register clears the interrupt & starts shifting
+another 8 bits
+*/
+func (v *VIA) startShiftRegister() {
+	v.clearInterrupt(INT_SR)
+
+	v.srActive = v.acr&ACR_SR_CTRL != SR_DISABLED
+	v.srCount = 0
+	v.srTimer = Word(v.timer2LatchLow) + 1
+	v.srClockLow = false
+}
+
+/*
+When the shift register is using an internal clock, CB1 is toggled at the
+selected rate. Under T2 the low order T2 latch sets the rate, with each half
+of the clock lasting N+2 cycles. Under the system clock a full bit is shifted
+on every cycle.
+*/
+func (v *VIA) clockShiftRegister() {
+	if !v.srActive {
+		return
+	}
+
+	switch v.acr & ACR_SR_CTRL {
+	case SR_IN_T2, SR_OUT_FREE_T2, SR_OUT_T2:
+		if v.srTimer > 0 {
+			v.srTimer = v.srTimer - 1
+			return
+		}
+		v.srTimer = Word(v.timer2LatchLow) + 1
+
+		v.srClockLow = !v.srClockLow
+		v.shift(!v.srClockLow)
+	case SR_IN_PHI2, SR_OUT_PHI2:
+		v.srClockLow = true
+		v.shift(false)
+		v.srClockLow = false
+		v.shift(true)
+	}
+}
+
+/*
+Handle an edge of the shift clock. When shifting out, the next bit is placed
+on CB2 on the falling edge. Bits are shifted on the rising edge: in from CB2,
+or rotated out when shifting out. Once 8 bits have been shifted the interrupt
+is raised & shifting stops, except in free-running mode which continues
+indefinitely without interrupting.
+*/
+func (v *VIA) shift(rising bool) {
+	out := v.acr&SR_OUT != 0
+
+	if !rising {
+		if out {
+			v.srData = v.sr&mos6502.BIT_7 != 0
+		}
+		return
+	}
+
+	if out {
+		v.sr = v.sr<<1 | v.sr>>7
+	} else {
+		var bit Byte
+		if v.cb2 {
+			bit = 1
+		}
+		v.sr = v.sr<<1 | bit
+	}
+
+	v.srCount++
+	if v.srCount == 8 {
+		v.srCount = 0
+		if v.acr&ACR_SR_CTRL != SR_OUT_FREE_T2 {
+			v.srActive = false
+			v.setInterrupt(INT_SR)
+		}
+	}
+}
+
+// VIAState holds the complete internal state of a VIA, for snapshots
+type VIAState struct {
+	PortB, PortBIn, PortBDir Byte
+	PortA, PortAIn, PortADir Byte
+	PortALatch, PortBLatch   Byte
+
+	Timer1LatchLow, Timer1LatchHigh Byte
+	Timer1Counter                   Word
+	Timer1Load, Timer1Reload        bool
+	Timer1Armed, Timer1PB7Low       bool
+
+	Timer2LatchLow          Byte
+	Timer2Counter           Word
+	Timer2Load, Timer2Armed bool
+
+	SR                 Byte
+	SRActive           bool
+	SRCount            int
+	SRTimer            Word
+	SRClockLow, SRData bool
+
+	ACR, PCR, IFR, IE Byte
+
+	CA1, CA2, CB1, CB2 bool
+	CA2Low, CA2Pulse   bool
+	CB2Low, CB2Pulse   bool
+}
+
+func (v *VIA) State() VIAState {
+	return VIAState{
+		PortB:           v.portB,
+		PortBIn:         v.portBIn,
+		PortBDir:        v.portBDir,
+		PortA:           v.portA,
+		PortAIn:         v.portAIn,
+		PortADir:        v.portADir,
+		PortALatch:      v.portALatch,
+		PortBLatch:      v.portBLatch,
+		Timer1LatchLow:  v.timer1LatchLow,
+		Timer1LatchHigh: v.timer1LatchHigh,
+		Timer1Counter:   v.timer1Counter,
+		Timer1Load:      v.timer1Load,
+		Timer1Reload:    v.timer1Reload,
+		Timer1Armed:     v.timer1Armed,
+		Timer1PB7Low:    v.timer1PB7Low,
+		Timer2LatchLow:  v.timer2LatchLow,
+		Timer2Counter:   v.timer2Counter,
+		Timer2Load:      v.timer2Load,
+		Timer2Armed:     v.timer2Armed,
+		SR:              v.sr,
+		SRActive:        v.srActive,
+		SRCount:         v.srCount,
+		SRTimer:         v.srTimer,
+		SRClockLow:      v.srClockLow,
+		SRData:          v.srData,
+		ACR:             v.acr,
+		PCR:             v.pcr,
+		IFR:             v.ifr,
+		IE:              v.ie,
+		CA1:             v.ca1,
+		CA2:             v.ca2,
+		CB1:             v.cb1,
+		CB2:             v.cb2,
+		CA2Low:          v.ca2Low,
+		CA2Pulse:        v.ca2Pulse,
+		CB2Low:          v.cb2Low,
+		CB2Pulse:        v.cb2Pulse,
+	}
+}
+
+func (v *VIA) SetState(s VIAState) {
+	v.portB = s.PortB
+	v.portBIn = s.PortBIn
+	v.portBDir = s.PortBDir
+	v.portA = s.PortA
+	v.portAIn = s.PortAIn
+	v.portADir = s.PortADir
+	v.portALatch = s.PortALatch
+	v.portBLatch = s.PortBLatch
+	v.timer1LatchLow = s.Timer1LatchLow
+	v.timer1LatchHigh = s.Timer1LatchHigh
+	v.timer1Counter = s.Timer1Counter
+	v.timer1Load = s.Timer1Load
+	v.timer1Reload = s.Timer1Reload
+	v.timer1Armed = s.Timer1Armed
+	v.timer1PB7Low = s.Timer1PB7Low
+	v.timer2LatchLow = s.Timer2LatchLow
+	v.timer2Counter = s.Timer2Counter
+	v.timer2Load = s.Timer2Load
+	v.timer2Armed = s.Timer2Armed
+	v.sr = s.SR
+	v.srActive = s.SRActive
+	v.srCount = s.SRCount
+	v.srTimer = s.SRTimer
+	v.srClockLow = s.SRClockLow
+	v.srData = s.SRData
+	v.acr = s.ACR
+	v.pcr = s.PCR
+	v.ifr = s.IFR
+	v.ie = s.IE
+	v.ca1 = s.CA1
+	v.ca2 = s.CA2
+	v.cb1 = s.CB1
+	v.cb2 = s.CB2
+	v.ca2Low = s.CA2Low
+	v.ca2Pulse = s.CA2Pulse
+	v.cb2Low = s.CB2Low
+	v.cb2Pulse = s.CB2Pulse
+}
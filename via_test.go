@@ -0,0 +1,786 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vanders/pet/mos6502"
+)
+
+// Load T1 with n in the given ACR mode
+func loadTimer1(acr Byte, n Word) *VIA {
+	v := &VIA{}
+	v.WriteRegister(AUXILLERY_CTRL, acr)
+	v.WriteRegister(INT_ENABLE, 0x80|INT_T1)
+	v.WriteRegister(TIMER_1_LOW, Byte(n&0xff))
+	v.WriteRegister(TIMER_1_HIGH, Byte(n>>8))
+	return v
+}
+
+func timer1Counter(v *VIA) Word {
+	return Word(v.PeekRegister(TIMER_1_HIGH))<<8 | Word(v.PeekRegister(TIMER_1_LOW))
+}
+
+func pb7(v *VIA) bool {
+	return v.Out(PORT_B)&mos6502.BIT_7 != 0
+}
+
+/*
+Timing diagram "Timer 1 One-Shot Mode": the counter decrements from N to 0
+then rolls over to $ffff, and IRQ is asserted N+1.5 cycles after the write to
+T1C-H. PB7 is low from the write until the interrupt.
+*/
+func TestTimer1OneShot(t *testing.T) {
+	const n = 5
+
+	v := loadTimer1(ACR_T1_PB7, n)
+
+	want := []Word{n, 4, 3, 2, 1, 0, 0xffff, 0xfffe, 0xfffd}
+	for cycle, w := range want {
+		v.Clock()
+
+		irq := cycle >= n+1
+		if got := timer1Counter(v); got != w {
+			t.Errorf("cycle %d: counter = $%04x, want $%04x", cycle+1, got, w)
+		}
+		if v.CheckInterrupt() != irq {
+			t.Errorf("cycle %d: IRQ = %t, want %t", cycle+1, v.CheckInterrupt(), irq)
+		}
+		if pb7(v) != irq {
+			t.Errorf("cycle %d: PB7 = %t, want %t", cycle+1, pb7(v), irq)
+		}
+	}
+
+	// Only one interrupt is raised until T1 is reloaded
+	v.ReadRegister(TIMER_1_LOW)
+	for n := 0; n < 0x10000; n++ {
+		v.Clock()
+		if v.CheckInterrupt() {
+			t.Fatalf("cycle %d: unexpected second interrupt", n)
+		}
+	}
+}
+
+/*
+Timing diagram "Timer 1 Free-Run Mode": interrupts are N+2 cycles apart, the
+counter holds $ffff for a cycle before reloading from the latches, & PB7 is
+inverted on every time out.
+*/
+func TestTimer1FreeRun(t *testing.T) {
+	const n = 3
+
+	v := loadTimer1(ACR_T1_CONTINUOUS|ACR_T1_PB7, n)
+
+	want := []Word{n, 2, 1, 0, 0xffff, n, 2, 1, 0, 0xffff, n}
+	var last int
+	for cycle, w := range want {
+		v.Clock()
+
+		if got := timer1Counter(v); got != w {
+			t.Errorf("cycle %d: counter = $%04x, want $%04x", cycle+1, got, w)
+		}
+		if v.CheckInterrupt() {
+			if last != 0 && cycle-last != n+2 {
+				t.Errorf("cycle %d: interrupt %d cycles after the last, want %d", cycle+1, cycle-last, n+2)
+			}
+			last = cycle
+
+			if v.ReadRegister(TIMER_1_LOW); v.CheckInterrupt() {
+				t.Errorf("cycle %d: reading T1C-L did not clear the interrupt", cycle+1)
+			}
+		}
+	}
+	if last == 0 {
+		t.Fatal("no interrupts")
+	}
+
+	// PB7 has toggled twice
+	if pb7(v) {
+		t.Errorf("PB7 = %t after two time outs, want false", pb7(v))
+	}
+}
+
+// Loading the latches does not affect the running counter, only the reload
+func TestTimer1LatchReload(t *testing.T) {
+	v := loadTimer1(ACR_T1_CONTINUOUS, 2)
+
+	v.WriteRegister(TIMER_1_LATCH_LOW, 0x10)
+	v.WriteRegister(TIMER_1_LATCH_HIGH, 0x00)
+
+	want := []Word{2, 1, 0, 0xffff, 0x10, 0x0f}
+	for cycle, w := range want {
+		v.Clock()
+		if got := timer1Counter(v); got != w {
+			t.Errorf("cycle %d: counter = $%04x, want $%04x", cycle+1, got, w)
+		}
+	}
+}
+
+func TestRegisterReadBack(t *testing.T) {
+	tests := []struct {
+		name string
+		r    VIARegister
+		data Byte
+		want Byte
+	}{
+		{"DDRB", PORT_B_DIR, 0x5a, 0x5a},
+		{"DDRA", PORT_A_DIR, 0xa5, 0xa5},
+		{"T1L-L", TIMER_1_LATCH_LOW, 0x12, 0x12},
+		{"T1L-H", TIMER_1_LATCH_HIGH, 0x34, 0x34},
+		{"SR", SHIFT, 0x81, 0x81},
+		{"ACR", AUXILLERY_CTRL, 0xc3, 0xc3},
+		{"PCR", PERIPHERAL_CTRL, 0xee, 0xee},
+		{"IER set", INT_ENABLE, 0xff, 0xff},
+		{"IER clear", INT_ENABLE, 0x7f, 0x80},
+		{"IFR", INT_FLAGS, 0xff, 0x00},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VIA{}
+			v.WriteRegister(tt.r, tt.data)
+			if got := v.ReadRegister(tt.r); got != tt.want {
+				t.Errorf("read $%02x, want $%02x", got, tt.want)
+			}
+		})
+	}
+}
+
+// The T1 latches can be loaded through the counter registers too
+func TestTimer1LatchRegisters(t *testing.T) {
+	v := &VIA{}
+	v.WriteRegister(TIMER_1_LOW, 0x34)
+	v.WriteRegister(TIMER_1_HIGH, 0x12)
+
+	if got := v.ReadRegister(TIMER_1_LATCH_LOW); got != 0x34 {
+		t.Errorf("T1L-L = $%02x, want $34", got)
+	}
+	if got := v.ReadRegister(TIMER_1_LATCH_HIGH); got != 0x12 {
+		t.Errorf("T1L-H = $%02x, want $12", got)
+	}
+	if got := timer1Counter(v); got != 0x1234 {
+		t.Errorf("T1 counter = $%04x, want $1234", got)
+	}
+}
+
+func TestPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    VIARegister
+		dir     Byte
+		out     Byte
+		in      Byte
+		wantOut Byte // Pins driven by the VIA
+		wantIn  Byte // Value read by the CPU
+	}{
+		{"A all inputs", PORT_A, 0x00, 0xff, 0x5a, 0x00, 0x5a},
+		{"A all outputs", PORT_A, 0xff, 0x3c, 0xff, 0x3c, 0x3c},
+		{"A mixed", PORT_A, 0x0f, 0xff, 0xa0, 0x0f, 0xaf},
+		{"B all inputs", PORT_B, 0x00, 0xff, 0x5a, 0x00, 0x5a},
+		{"B all outputs", PORT_B, 0xff, 0x3c, 0xff, 0x3c, 0x3c},
+		{"B mixed", PORT_B, 0xf0, 0x5f, 0x0a, 0x50, 0x5a},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := PORT_A_DIR
+			if tt.port == PORT_B {
+				dir = PORT_B_DIR
+			}
+
+			v := &VIA{}
+			v.WriteRegister(tt.port, tt.out)
+			v.WriteRegister(dir, tt.dir)
+			v.In(tt.port, tt.in)
+
+			if got := v.Out(tt.port); got != tt.wantOut {
+				t.Errorf("Out = $%02x, want $%02x", got, tt.wantOut)
+			}
+			if got := v.ReadRegister(tt.port); got != tt.wantIn {
+				t.Errorf("read $%02x, want $%02x", got, tt.wantIn)
+			}
+		})
+	}
+}
+
+func TestInterruptEnable(t *testing.T) {
+	v := &VIA{}
+
+	steps := []struct {
+		write Byte
+		want  Byte
+	}{
+		{0x82, 0x82},
+		{0xc0, 0xc2},
+		{0x02, 0xc0},
+		{0x10, 0xc0},
+		{0xff, 0xff},
+		{0x7f, 0x80},
+	}
+	for n, s := range steps {
+		v.WriteRegister(INT_ENABLE, s.write)
+		if got := v.ReadRegister(INT_ENABLE); got != s.want {
+			t.Errorf("step %d: wrote $%02x, read $%02x, want $%02x", n, s.write, got, s.want)
+		}
+	}
+}
+
+func TestInterruptFlags(t *testing.T) {
+	v := &VIA{}
+
+	// A flag is set without an IRQ while it is disabled
+	v.CtrlIn(CTRL_CA1, true)
+	v.CtrlIn(CTRL_CA1, false)
+	if got := v.ReadRegister(INT_FLAGS); got != INT_CA1 {
+		t.Fatalf("IFR = $%02x, want $%02x", got, INT_CA1)
+	}
+	if v.CheckInterrupt() {
+		t.Error("IRQ with interrupt disabled")
+	}
+
+	// Enabling the interrupt raises IRQ
+	v.WriteRegister(INT_ENABLE, 0x80|INT_CA1)
+	if got := v.ReadRegister(INT_FLAGS); got != INT_IRQ|INT_CA1 {
+		t.Errorf("IFR = $%02x, want $%02x", got, INT_IRQ|INT_CA1)
+	}
+	if !v.CheckInterrupt() {
+		t.Error("no IRQ with interrupt enabled")
+	}
+
+	// Disabling it again clears IRQ but not the flag
+	v.WriteRegister(INT_ENABLE, INT_CA1)
+	if got := v.ReadRegister(INT_FLAGS); got != INT_CA1 {
+		t.Errorf("IFR = $%02x, want $%02x", got, INT_CA1)
+	}
+
+	// Writing a 1 to a flag clears it
+	v.WriteRegister(INT_ENABLE, 0x80|INT_CA1)
+	v.WriteRegister(INT_FLAGS, INT_CA1)
+	if got := v.ReadRegister(INT_FLAGS); got != 0 {
+		t.Errorf("IFR = $%02x after clear, want $00", got)
+	}
+	if v.CheckInterrupt() {
+		t.Error("IRQ after clearing the flag")
+	}
+}
+
+func TestIFRWriteClearsEveryFlag(t *testing.T) {
+	for bit := 0; bit < 7; bit++ {
+		flag := VIAInterrupt(1 << bit)
+
+		v := &VIA{}
+		v.WriteRegister(INT_ENABLE, 0xff)
+		v.setInterrupt(flag)
+		v.WriteRegister(INT_FLAGS, flag)
+		if got := v.ReadRegister(INT_FLAGS); got != 0 {
+			t.Errorf("flag $%02x: IFR = $%02x after clear, want $00", flag, got)
+		}
+	}
+}
+
+func TestControlLineEdges(t *testing.T) {
+	tests := []struct {
+		name string
+		line VIAControl
+		pcr  Byte
+		flag VIAInterrupt
+		from bool
+		to   bool
+		want bool
+	}{
+		{"CA1 negative, falls", CTRL_CA1, 0x00, INT_CA1, true, false, true},
+		{"CA1 negative, rises", CTRL_CA1, 0x00, INT_CA1, false, true, false},
+		{"CA1 positive, rises", CTRL_CA1, PCR_CA1_CTRL, INT_CA1, false, true, true},
+		{"CA1 positive, falls", CTRL_CA1, PCR_CA1_CTRL, INT_CA1, true, false, false},
+		{"CB1 negative, falls", CTRL_CB1, 0x00, INT_CB1, true, false, true},
+		{"CB1 negative, rises", CTRL_CB1, 0x00, INT_CB1, false, true, false},
+		{"CB1 positive, rises", CTRL_CB1, PCR_CB1_CTRL, INT_CB1, false, true, true},
+		{"CB1 positive, falls", CTRL_CB1, PCR_CB1_CTRL, INT_CB1, true, false, false},
+
+		{"CA2 negative, falls", CTRL_CA2, CTRL_INPUT_NEG << 1, INT_CA2, true, false, true},
+		{"CA2 negative, rises", CTRL_CA2, CTRL_INPUT_NEG << 1, INT_CA2, false, true, false},
+		{"CA2 independent negative, falls", CTRL_CA2, CTRL_INPUT_NEG_INDEP << 1, INT_CA2, true, false, true},
+		{"CA2 positive, rises", CTRL_CA2, CTRL_INPUT_POS << 1, INT_CA2, false, true, true},
+		{"CA2 positive, falls", CTRL_CA2, CTRL_INPUT_POS << 1, INT_CA2, true, false, false},
+		{"CA2 independent positive, rises", CTRL_CA2, CTRL_INPUT_POS_INDEP << 1, INT_CA2, false, true, true},
+		{"CA2 output, falls", CTRL_CA2, CTRL_HANDSHAKE << 1, INT_CA2, true, false, false},
+
+		{"CB2 negative, falls", CTRL_CB2, CTRL_INPUT_NEG << 5, INT_CB2, true, false, true},
+		{"CB2 negative, rises", CTRL_CB2, CTRL_INPUT_NEG << 5, INT_CB2, false, true, false},
+		{"CB2 independent negative, falls", CTRL_CB2, CTRL_INPUT_NEG_INDEP << 5, INT_CB2, true, false, true},
+		{"CB2 positive, rises", CTRL_CB2, CTRL_INPUT_POS << 5, INT_CB2, false, true, true},
+		{"CB2 positive, falls", CTRL_CB2, CTRL_INPUT_POS << 5, INT_CB2, true, false, false},
+		{"CB2 independent positive, rises", CTRL_CB2, CTRL_INPUT_POS_INDEP << 5, INT_CB2, false, true, true},
+		{"CB2 output, rises", CTRL_CB2, CTRL_HIGH << 5, INT_CB2, false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VIA{}
+
+			// Set the starting level, then clear any flag that it raised
+			v.WriteRegister(PERIPHERAL_CTRL, tt.pcr)
+			v.CtrlIn(tt.line, tt.from)
+			v.WriteRegister(INT_FLAGS, 0x7f)
+
+			v.CtrlIn(tt.line, tt.to)
+			if got := v.ReadRegister(INT_FLAGS)&tt.flag != 0; got != tt.want {
+				t.Errorf("flag = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortAccessClearsFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		pcr    Byte
+		write  bool
+		port   VIARegister
+		remain VIAInterrupt // Flags left set after the access
+	}{
+		{"read A", 0x00, false, PORT_A, INT_CB1 | INT_CB2},
+		{"write A", 0x00, true, PORT_A, INT_CB1 | INT_CB2},
+		{"read A, independent CA2", CTRL_INPUT_NEG_INDEP << 1, false, PORT_A, INT_CA2 | INT_CB1 | INT_CB2},
+		{"read A without handshake", 0x00, false, PORT_A_NHS, INT_CA1 | INT_CA2 | INT_CB1 | INT_CB2},
+		{"write A without handshake", 0x00, true, PORT_A_NHS, INT_CA1 | INT_CA2 | INT_CB1 | INT_CB2},
+		{"read B", 0x00, false, PORT_B, INT_CA1 | INT_CA2},
+		{"write B", 0x00, true, PORT_B, INT_CA1 | INT_CA2},
+		{"read B, independent CB2", CTRL_INPUT_NEG_INDEP << 5, false, PORT_B, INT_CA1 | INT_CA2 | INT_CB2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VIA{}
+			v.WriteRegister(PERIPHERAL_CTRL, tt.pcr)
+			v.setInterrupt(INT_CA1 | INT_CA2 | INT_CB1 | INT_CB2)
+
+			if tt.write {
+				v.WriteRegister(tt.port, 0)
+			} else {
+				v.ReadRegister(tt.port)
+			}
+
+			if got := v.ReadRegister(INT_FLAGS); got != tt.remain {
+				t.Errorf("IFR = $%02x, want $%02x", got, tt.remain)
+			}
+		})
+	}
+}
+
+func TestCA2Outputs(t *testing.T) {
+	v := &VIA{}
+
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_LOW<<1)
+	if v.CtrlOut(CTRL_CA2) {
+		t.Error("manual low: CA2 is high")
+	}
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_HIGH<<1)
+	if !v.CtrlOut(CTRL_CA2) {
+		t.Error("manual high: CA2 is low")
+	}
+
+	// Handshake: low on a port A read or write, high again on the CA1 edge
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_HANDSHAKE<<1|PCR_CA1_CTRL)
+	if !v.CtrlOut(CTRL_CA2) {
+		t.Error("handshake: CA2 is not high initially")
+	}
+	for _, write := range []bool{false, true} {
+		if write {
+			v.WriteRegister(PORT_A, 0)
+		} else {
+			v.ReadRegister(PORT_A)
+		}
+		v.Clock()
+		if v.CtrlOut(CTRL_CA2) {
+			t.Errorf("handshake: CA2 is high after port access (write=%t)", write)
+		}
+		v.CtrlIn(CTRL_CA1, true)
+		if !v.CtrlOut(CTRL_CA2) {
+			t.Errorf("handshake: CA2 is low after CA1 (write=%t)", write)
+		}
+		v.CtrlIn(CTRL_CA1, false)
+	}
+
+	// Port A without handshake leaves CA2 alone
+	v.ReadRegister(PORT_A_NHS)
+	if !v.CtrlOut(CTRL_CA2) {
+		t.Error("handshake: CA2 went low without handshake")
+	}
+
+	// Pulse: low for one cycle after a port A read or write
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_PULSE<<1)
+	v.ReadRegister(PORT_A)
+	if v.CtrlOut(CTRL_CA2) {
+		t.Error("pulse: CA2 is high after port access")
+	}
+	v.Clock()
+	if !v.CtrlOut(CTRL_CA2) {
+		t.Error("pulse: CA2 is still low after a cycle")
+	}
+}
+
+func TestCB2Outputs(t *testing.T) {
+	v := &VIA{}
+
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_LOW<<5)
+	if v.CtrlOut(CTRL_CB2) {
+		t.Error("manual low: CB2 is high")
+	}
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_HIGH<<5)
+	if !v.CtrlOut(CTRL_CB2) {
+		t.Error("manual high: CB2 is low")
+	}
+
+	// Handshake: only writes to port B start the handshake
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_HANDSHAKE<<5)
+	v.ReadRegister(PORT_B)
+	if !v.CtrlOut(CTRL_CB2) {
+		t.Error("handshake: CB2 went low on a read")
+	}
+	v.WriteRegister(PORT_B, 0)
+	if v.CtrlOut(CTRL_CB2) {
+		t.Error("handshake: CB2 is high after a write")
+	}
+	v.CtrlIn(CTRL_CB1, true)
+	v.CtrlIn(CTRL_CB1, false)
+	if !v.CtrlOut(CTRL_CB2) {
+		t.Error("handshake: CB2 is low after CB1")
+	}
+
+	// Pulse: low for one cycle after a port B write
+	v.WriteRegister(PERIPHERAL_CTRL, CTRL_PULSE<<5)
+	v.WriteRegister(PORT_B, 0)
+	if v.CtrlOut(CTRL_CB2) {
+		t.Error("pulse: CB2 is high after a write")
+	}
+	v.Clock()
+	if !v.CtrlOut(CTRL_CB2) {
+		t.Error("pulse: CB2 is still low after a cycle")
+	}
+}
+
+func TestInputLatching(t *testing.T) {
+	v := &VIA{}
+	v.WriteRegister(AUXILLERY_CTRL, ACR_PA_LATCH|ACR_PB_LATCH)
+	v.WriteRegister(PORT_B_DIR, 0xf0)
+	v.WriteRegister(PORT_B, 0xa0)
+
+	v.In(PORT_A, 0x12)
+	v.In(PORT_B, 0x03)
+	v.CtrlIn(CTRL_CA1, true)
+	v.CtrlIn(CTRL_CA1, false)
+	v.CtrlIn(CTRL_CB1, true)
+	v.CtrlIn(CTRL_CB1, false)
+
+	// The inputs change after the latch
+	v.In(PORT_A, 0x34)
+	v.In(PORT_B, 0x0c)
+
+	if got := v.ReadRegister(PORT_A); got != 0x12 {
+		t.Errorf("port A = $%02x, want latched $12", got)
+	}
+	if got := v.ReadRegister(PORT_B); got != 0xa3 {
+		t.Errorf("port B = $%02x, want $a3 (outputs plus latched inputs)", got)
+	}
+
+	// Without latching the current inputs are read
+	v.WriteRegister(AUXILLERY_CTRL, 0)
+	if got := v.ReadRegister(PORT_A); got != 0x34 {
+		t.Errorf("port A = $%02x, want $34", got)
+	}
+	if got := v.ReadRegister(PORT_B); got != 0xac {
+		t.Errorf("port B = $%02x, want $ac", got)
+	}
+}
+
+func TestTimer2OneShot(t *testing.T) {
+	const n = 4
+
+	v := &VIA{}
+	v.WriteRegister(INT_ENABLE, 0x80|INT_T2)
+	v.WriteRegister(TIMER_2_LOW, n)
+	v.WriteRegister(TIMER_2_HIGH, 0)
+
+	want := []Word{n, 3, 2, 1, 0, 0xffff, 0xfffe}
+	for cycle, w := range want {
+		v.Clock()
+
+		got := Word(v.PeekRegister(TIMER_2_HIGH))<<8 | Word(v.PeekRegister(TIMER_2_LOW))
+		if got != w {
+			t.Errorf("cycle %d: counter = $%04x, want $%04x", cycle+1, got, w)
+		}
+		if irq := cycle >= n+1; v.CheckInterrupt() != irq {
+			t.Errorf("cycle %d: IRQ = %t, want %t", cycle+1, v.CheckInterrupt(), irq)
+		}
+	}
+
+	// Reading T2C-L clears the interrupt, and no more are raised
+	v.ReadRegister(TIMER_2_LOW)
+	for n := 0; n < 0x10000; n++ {
+		v.Clock()
+		if v.CheckInterrupt() {
+			t.Fatalf("cycle %d: unexpected second interrupt", n)
+		}
+	}
+
+	// Writing T2C-H clears the interrupt
+	v.setInterrupt(INT_T2)
+	v.WriteRegister(TIMER_2_HIGH, 0)
+	if v.CheckInterrupt() {
+		t.Error("writing T2C-H did not clear the interrupt")
+	}
+}
+
+func TestTimer2PulseCounting(t *testing.T) {
+	v := &VIA{}
+	v.WriteRegister(AUXILLERY_CTRL, ACR_T2_PULSE_COUNT)
+	v.WriteRegister(INT_ENABLE, 0x80|INT_T2)
+	v.WriteRegister(TIMER_2_LOW, 3)
+	v.WriteRegister(TIMER_2_HIGH, 0)
+
+	// The clock has no effect
+	for n := 0; n < 10; n++ {
+		v.Clock()
+	}
+	if got := v.PeekRegister(TIMER_2_LOW); got != 3 {
+		t.Fatalf("counter = $%02x after clocking, want $03", got)
+	}
+
+	for pulse := 1; pulse <= 4; pulse++ {
+		v.In(PORT_B, mos6502.BIT_6)
+		v.In(PORT_B, 0)
+
+		want := Byte(3 - pulse)
+		if got := v.PeekRegister(TIMER_2_LOW); got != want {
+			t.Errorf("pulse %d: counter = $%02x, want $%02x", pulse, got, want)
+		}
+		if irq := pulse >= 3; v.CheckInterrupt() != irq {
+			t.Errorf("pulse %d: IRQ = %t, want %t", pulse, v.CheckInterrupt(), irq)
+		}
+	}
+}
+
+/*
+Shift 8 bits with an internal clock, returning the bits seen on CB2. Under the
+system clock a whole CB1 pulse happens within a cycle, so CB2 is sampled on
+every cycle.
+*/
+func shiftInternal(v *VIA, maxCycles int) (bits Byte, cycles int) {
+	var n int
+	mode := v.acr & ACR_SR_CTRL
+	phi2 := mode == SR_IN_PHI2 || mode == SR_OUT_PHI2
+
+	clock := v.CtrlOut(CTRL_CB1)
+	for cycles = 1; cycles <= maxCycles; cycles++ {
+		v.Clock()
+
+		// Sample CB2 on the rising edge of CB1
+		c := v.CtrlOut(CTRL_CB1)
+		if (phi2 || c && !clock) && n < 8 {
+			bits = bits << 1
+			if v.CtrlOut(CTRL_CB2) {
+				bits = bits | 1
+			}
+			n++
+		}
+		clock = c
+
+		if v.ReadRegister(INT_FLAGS)&INT_SR != 0 {
+			break
+		}
+	}
+	return bits, cycles
+}
+
+func TestShiftRegister(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   Byte
+		t2     Byte
+		data   Byte
+		cycles int  // Cycles taken to shift 8 bits
+		want   Byte // SR afterwards
+	}{
+		{"in under T2", SR_IN_T2, 2, 0x00, 8 * 2 * (2 + 2), 0xff},
+		{"in under phi2", SR_IN_PHI2, 0, 0x00, 8, 0xff},
+		{"out under T2", SR_OUT_T2, 1, 0xa5, 8 * 2 * (1 + 2), 0xa5},
+		{"out under phi2", SR_OUT_PHI2, 0, 0x3c, 8, 0x3c},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VIA{}
+			v.WriteRegister(AUXILLERY_CTRL, tt.mode)
+			v.WriteRegister(TIMER_2_LOW, tt.t2)
+
+			// Shifted in data comes from CB2
+			v.CtrlIn(CTRL_CB2, true)
+
+			v.WriteRegister(SHIFT, tt.data)
+			bits, cycles := shiftInternal(v, 1000)
+
+			if cycles != tt.cycles {
+				t.Errorf("took %d cycles, want %d", cycles, tt.cycles)
+			}
+			if tt.mode&SR_OUT != 0 && bits != tt.data {
+				t.Errorf("shifted out $%02x, want $%02x", bits, tt.data)
+			}
+			if got := v.PeekRegister(SHIFT); got != tt.want {
+				t.Errorf("SR = $%02x, want $%02x", got, tt.want)
+			}
+
+			// Shifting stops after 8 bits with CB1 high
+			v.ReadRegister(INT_FLAGS)
+			v.WriteRegister(INT_FLAGS, INT_SR)
+			for n := 0; n < 100; n++ {
+				v.Clock()
+			}
+			if v.ReadRegister(INT_FLAGS)&INT_SR != 0 {
+				t.Error("shift register restarted without being accessed")
+			}
+			if !v.CtrlOut(CTRL_CB1) {
+				t.Error("CB1 is low after shifting")
+			}
+		})
+	}
+}
+
+func TestShiftRegisterExternalClock(t *testing.T) {
+	tests := []struct {
+		name string
+		mode Byte
+		data Byte
+		in   Byte
+		want Byte
+	}{
+		{"in under CB1", SR_IN_CB1, 0x00, 0xb2, 0xb2},
+		{"out under CB1", SR_OUT_CB1, 0x96, 0x00, 0x96},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VIA{}
+			v.WriteRegister(AUXILLERY_CTRL, tt.mode)
+			v.CtrlIn(CTRL_CB1, true)
+			v.WriteRegister(SHIFT, tt.data)
+
+			var out Byte
+			for n := 7; n >= 0; n-- {
+				v.CtrlIn(CTRL_CB2, tt.in&(1<<n) != 0)
+				v.CtrlIn(CTRL_CB1, false)
+				v.CtrlIn(CTRL_CB1, true)
+
+				out = out << 1
+				if v.CtrlOut(CTRL_CB2) {
+					out = out | 1
+				}
+			}
+
+			if got := v.PeekRegister(SHIFT); got != tt.want {
+				t.Errorf("SR = $%02x, want $%02x", got, tt.want)
+			}
+			if tt.mode&SR_OUT != 0 && out != tt.data {
+				t.Errorf("shifted out $%02x, want $%02x", out, tt.data)
+			}
+			if v.ReadRegister(INT_FLAGS)&INT_SR == 0 {
+				t.Error("no interrupt after 8 bits")
+			}
+		})
+	}
+}
+
+// In free-running mode the SR rotates continuously without interrupting
+func TestShiftRegisterFreeRunning(t *testing.T) {
+	v := &VIA{}
+	v.WriteRegister(AUXILLERY_CTRL, SR_OUT_FREE_T2)
+	v.WriteRegister(TIMER_2_LOW, 0)
+	v.WriteRegister(SHIFT, 0x81)
+
+	// 8 bits take 8 * 2 * (N+2) cycles
+	for n := 0; n < 3*8*2*2; n++ {
+		v.Clock()
+	}
+	if v.ReadRegister(INT_FLAGS)&INT_SR != 0 {
+		t.Error("interrupt in free-running mode")
+	}
+	if got := v.PeekRegister(SHIFT); got != 0x81 {
+		t.Errorf("SR = $%02x after 3 rotations, want $81", got)
+	}
+}
+
+// Reading or writing the SR clears its interrupt
+func TestShiftRegisterClearsInterrupt(t *testing.T) {
+	for _, write := range []bool{false, true} {
+		v := &VIA{}
+		v.setInterrupt(INT_SR)
+		if write {
+			v.WriteRegister(SHIFT, 0)
+		} else {
+			v.ReadRegister(SHIFT)
+		}
+		if v.ReadRegister(INT_FLAGS)&INT_SR != 0 {
+			t.Errorf("write=%t: SR access did not clear the interrupt", write)
+		}
+	}
+}
+
+// Advancing in bulk must leave the VIA in the same state as clocking it
+func TestAdvanceMatchesClock(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(v *VIA)
+	}{
+		{"idle", func(v *VIA) {}},
+		{"T1 one-shot", func(v *VIA) {
+			v.WriteRegister(TIMER_1_LOW, 0x20)
+			v.WriteRegister(TIMER_1_HIGH, 0x01)
+		}},
+		{"T1 free-run with PB7", func(v *VIA) {
+			v.WriteRegister(AUXILLERY_CTRL, ACR_T1_CONTINUOUS|ACR_T1_PB7)
+			v.WriteRegister(TIMER_1_LOW, 0x11)
+			v.WriteRegister(TIMER_1_HIGH, 0x00)
+		}},
+		{"T2 one-shot", func(v *VIA) {
+			v.WriteRegister(TIMER_2_LOW, 0x40)
+			v.WriteRegister(TIMER_2_HIGH, 0x00)
+		}},
+		{"SR out under T2", func(v *VIA) {
+			v.WriteRegister(AUXILLERY_CTRL, SR_OUT_T2)
+			v.WriteRegister(TIMER_2_LOW, 0x07)
+			v.WriteRegister(SHIFT, 0x5a)
+		}},
+		{"SR free-running", func(v *VIA) {
+			v.WriteRegister(AUXILLERY_CTRL, SR_OUT_FREE_T2)
+			v.WriteRegister(TIMER_2_LOW, 0x03)
+			v.WriteRegister(SHIFT, 0x81)
+		}},
+		{"SR in under phi2", func(v *VIA) {
+			v.WriteRegister(AUXILLERY_CTRL, SR_IN_PHI2)
+			v.WriteRegister(SHIFT, 0x00)
+		}},
+		{"CB2 pulse", func(v *VIA) {
+			v.WriteRegister(PERIPHERAL_CTRL, CTRL_PULSE<<5)
+			v.WriteRegister(PORT_B, 0)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, cycles := range []int{1, 2, 7, 100, 300, 70000} {
+				clocked := &VIA{}
+				clocked.WriteRegister(INT_ENABLE, 0xff)
+				tt.setup(clocked)
+				advanced := *clocked
+
+				for n := 0; n < cycles; n++ {
+					clocked.Clock()
+				}
+				advanced.Advance(cycles)
+
+				if advanced != *clocked {
+					t.Errorf("%d cycles: state differs\nclocked:  %+v\nadvanced: %+v", cycles, *clocked, advanced)
+				}
+			}
+		})
+	}
+}